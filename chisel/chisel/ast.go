@@ -0,0 +1,556 @@
+package chisel
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// cppReserved are field names that would not compile or would hide the
+// members of the generated classes.
+var cppReserved = map[string]bool{
+	"alignas": true, "alignof": true, "and": true, "asm": true, "auto": true,
+	"bool": true, "break": true, "case": true, "catch": true, "char": true,
+	"class": true, "const": true, "constexpr": true, "continue": true,
+	"default": true, "delete": true, "do": true, "double": true, "else": true,
+	"enum": true, "explicit": true, "export": true, "extern": true,
+	"false": true, "float": true, "for": true, "friend": true, "goto": true,
+	"if": true, "inline": true, "int": true, "long": true, "mutable": true,
+	"namespace": true, "new": true, "noexcept": true, "not": true,
+	"nullptr": true, "operator": true, "or": true, "private": true,
+	"protected": true, "public": true, "register": true, "return": true,
+	"short": true, "signed": true, "sizeof": true, "static": true,
+	"struct": true, "switch": true, "template": true, "this": true,
+	"throw": true, "true": true, "try": true, "typedef": true,
+	"typename": true, "union": true, "unsigned": true, "using": true,
+	"virtual": true, "void": true, "volatile": true, "while": true,
+	"xor": true,
+
+	"build": true,
+	"match": true,
+}
+
+// astClass generates the typed class of one construct. The class mirrors
+// the rule: tokens become Token, constructs std::shared_ptr, sequences
+// structs, alternations std::variant, repetition std::vector and optional
+// parts std::optional. Matchers rebuild that shape from the flat children of
+// the construct's ParseNode.
+type astClass struct {
+	construct *Construct
+	groups    int
+	structs   strings.Builder
+	matchers  strings.Builder
+
+	// The alternative of a precedence construct matching a lone operand,
+	// and its index in the class's variant.
+	operand      string
+	operandIndex int
+}
+
+// astShape is the rule a construct's ParseNode children follow. Left folded
+// and precedence constructs nest nodes of their own type.
+func (c *Construct) astShape() Regex {
+	self := func(label string) Regex {
+		return &LabelRegex{Label: label, Inner: &NestedRegex{Construct: Construct{Name: c.Name}}}
+	}
+	operators := func(ops []Operator) Regex {
+		units := []Regex{}
+		for _, op := range ops {
+			units = append(units, &UnitRegex{Token: op.Token})
+		}
+		return &LabelRegex{Label: "op", Inner: choice(units)}
+	}
+
+	switch {
+	case c.Precedence != nil:
+		alts := []Regex{}
+		if len(c.Precedence.Prefix) > 0 {
+			alts = append(alts, sequence([]Regex{operators(c.Precedence.Prefix), self("operand")}))
+		}
+		if len(c.Precedence.Infix) > 0 {
+			alts = append(alts, sequence([]Regex{self("left"), operators(c.Precedence.Infix), self("right")}))
+		}
+		return choice(append(alts, c.Value))
+	case c.Tail != nil:
+		label := c.TailLabel
+		if label == "" {
+			label = "left"
+		}
+		return choice([]Regex{c.Value, sequence(append([]Regex{self(label)}, elements(c.Tail)...))})
+	default:
+		return c.Value
+	}
+}
+
+// fieldName names the member holding r inside a sequence.
+func fieldName(r Regex) string {
+	switch v := r.(type) {
+	case *LabelRegex:
+		return v.Label
+	case *UnitRegex:
+		return strings.ToLower(TokenName(v.Token))
+	case *NestedRegex:
+		return strings.ToLower(v.Construct.Name)
+	case *CapturedRegex:
+		return fieldName(v.Inner)
+	case *MultiplierRegex:
+		return fieldName(v.Inner)
+	case *OptionalRegex:
+		return fieldName(v.Inner)
+	case *BoundedRegex:
+		return fieldName(v.Inner)
+	case *SeparatedRegex:
+		return fieldName(v.Item)
+	default:
+		return "item"
+	}
+}
+
+// tokenChoice reports whether every alternative of r is a token, in which
+// case the alternation is held as a single Token.
+func tokenChoice(r *OrRegex) bool {
+	for _, re := range r.Chain {
+		if _, ok := re.(*UnitRegex); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *astClass) matcher() string {
+	a.groups++
+	return fmt.Sprintf("match_%s_%d", a.construct.Name, a.groups)
+}
+
+// fields declares the members of a sequence and returns the matcher filling
+// them into `typ`.
+func (a *astClass) fields(rs []Regex, typ string, decls *strings.Builder) string {
+	used := map[string]int{}
+	calls := []string{}
+	for _, re := range rs {
+		t, m := a.shape(re)
+		if t == "" {
+			continue
+		}
+
+		name := fieldName(re)
+		if cppReserved[name] {
+			name += "_"
+		}
+		if used[name]++; used[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, used[name])
+		}
+
+		decls.WriteString(fmt.Sprintf("%s %s;\n", t, name))
+		calls = append(calls, fmt.Sprintf("%s(list, i, out.%s)", m, name))
+	}
+	if len(calls) == 0 {
+		calls = append(calls, "true")
+	}
+
+	name := a.matcher()
+	a.matchers.WriteString(fmt.Sprintf(
+		`
+		static bool %s(const Nodes &list, size_t &i, %s &out) {
+			auto start = i;
+			if (!(%s)) {
+				i = start;
+				return false;
+			}
+			return true;
+		}
+		`,
+		name,
+		typ,
+		strings.Join(calls, " && "),
+	))
+	return name
+}
+
+// choice returns the type and matcher of an alternation. A top level
+// alternation only accepts alternatives matching every child.
+func (a *astClass) choice(r *OrRegex, top bool) (string, string) {
+	types := []string{}
+	matchers := []string{}
+	for _, re := range r.Chain {
+		if t, m := a.shape(re); t != "" {
+			types = append(types, t)
+			matchers = append(matchers, m)
+		}
+	}
+	if len(types) == 0 {
+		return "", ""
+	}
+	if top && a.construct.Precedence != nil {
+		a.operandIndex = len(types) - 1
+		a.operand = fmt.Sprintf("%s v;\nif (!%s(list, i, v) || i != list.size()) return false;\nresult->value.emplace<%d>(std::move(v));",
+			types[a.operandIndex], matchers[a.operandIndex], a.operandIndex)
+	}
+
+	typ := "Token"
+	if !tokenChoice(r) {
+		typ = fmt.Sprintf("std::variant<%s>", strings.Join(types, ", "))
+	}
+	end := ""
+	if top {
+		end = " && i == list.size()"
+	}
+
+	var body strings.Builder
+	for index, m := range matchers {
+		if typ == "Token" {
+			body.WriteString(fmt.Sprintf(
+				"if (%s(list, i, out)%s) return true;\ni = start;\n",
+				m, end,
+			))
+			continue
+		}
+		body.WriteString(fmt.Sprintf(
+			"{ %s v; if (%s(list, i, v)%s) { out.emplace<%d>(std::move(v)); return true; } i = start; }\n",
+			types[index], m, end, index,
+		))
+	}
+
+	name := a.matcher()
+	a.matchers.WriteString(fmt.Sprintf(
+		`
+		static bool %s(const Nodes &list, size_t &i, %s &out) {
+			auto start = i;
+			%s
+			return false;
+		}
+		`,
+		name,
+		typ,
+		body.String(),
+	))
+	return typ, name
+}
+
+// shape returns the C++ type holding a match of r and the matcher filling
+// it, or an empty type when r never produces a node.
+func (a *astClass) shape(r Regex) (string, string) {
+	switch v := r.(type) {
+	case *UnitRegex:
+		if TokenDropped(v.Token) {
+			return "", ""
+		}
+		name := a.matcher()
+		a.matchers.WriteString(fmt.Sprintf(
+			`
+			static bool %s(const Nodes &list, size_t &i, Token &out) {
+				if (i < list.size() && list[i]->holds_token() && list[i]->get_token().get_type() == Token::Type::%s) {
+					out = list[i++]->get_token();
+					return true;
+				}
+				return false;
+			}
+			`,
+			name,
+			TokenName(v.Token),
+		))
+		return "Token", name
+	case *NestedRegex:
+		if v.Construct.Lexical {
+			return a.shape(&UnitRegex{Token: SimpleToken{Name: v.Construct.Name}})
+		}
+		if v.Construct.Inline {
+			// The children are spliced in, so they follow the inline rule
+			if v.Construct.Value == nil {
+				log.Fatalf("-ast: inline construct %s cannot refer to itself\n", v.Construct.Name)
+			}
+			return a.shape(v.Construct.Value)
+		}
+		typ := fmt.Sprintf("std::shared_ptr<%s>", v.Construct.Name)
+		name := a.matcher()
+		a.matchers.WriteString(fmt.Sprintf(
+			`
+			static bool %s(const Nodes &list, size_t &i, %s &out) {
+				if (i < list.size() && %s::match(*list[i], out)) {
+					++i;
+					return true;
+				}
+				return false;
+			}
+			`,
+			name,
+			typ,
+			v.Construct.Name,
+		))
+		return typ, name
+	case *ChainRegex:
+		a.groups++
+		typ := fmt.Sprintf("Group%d", a.groups)
+		var decls strings.Builder
+		name := a.fields(v.Chain, a.construct.Name+"::"+typ, &decls)
+		a.structs.WriteString(fmt.Sprintf("struct %s {\n%s};\n", typ, decls.String()))
+		return a.construct.Name + "::" + typ, name
+	case *OrRegex:
+		return a.choice(v, false)
+	case *CapturedRegex:
+		return a.shape(v.Inner)
+	case *LabelRegex:
+		return a.shape(v.Inner)
+	case *MultiplierRegex:
+		t, m := a.shape(v.Inner)
+		if t == "" {
+			return "", ""
+		}
+		least := 0
+		if v.RequireOne {
+			least = 1
+		}
+		typ := fmt.Sprintf("std::vector<%s>", t)
+		name := a.matcher()
+		a.matchers.WriteString(fmt.Sprintf(
+			`
+			static bool %s(const Nodes &list, size_t &i, %s &out) {
+				auto first = i;
+				for (;;) {
+					auto start = i;
+					%s v;
+					if (!%s(list, i, v) || i == start) {
+						i = start;
+						break;
+					}
+					out.push_back(std::move(v));
+				}
+				if (out.size() < %d) {
+					i = first;
+					return false;
+				}
+				return true;
+			}
+			`,
+			name,
+			typ,
+			t,
+			m,
+			least,
+		))
+		return typ, name
+	case *BoundedRegex:
+		t, m := a.shape(v.Inner)
+		if t == "" {
+			return "", ""
+		}
+		more := "true"
+		if v.Max >= 0 {
+			more = fmt.Sprintf("out.size() < %d", v.Max)
+		}
+		typ := fmt.Sprintf("std::vector<%s>", t)
+		name := a.matcher()
+		a.matchers.WriteString(fmt.Sprintf(
+			`
+			static bool %s(const Nodes &list, size_t &i, %s &out) {
+				auto first = i;
+				while (%s) {
+					auto start = i;
+					%s v;
+					if (!%s(list, i, v) || i == start) {
+						i = start;
+						break;
+					}
+					out.push_back(std::move(v));
+				}
+				if (out.size() < %d) {
+					i = first;
+					return false;
+				}
+				return true;
+			}
+			`,
+			name,
+			typ,
+			more,
+			t,
+			m,
+			v.Min,
+		))
+		return typ, name
+	case *SeparatedRegex:
+		t, m := a.shape(v.Item)
+		st, sm := a.shape(v.Separator)
+		if t == "" {
+			if st != "" {
+				log.Fatalf("-ast: the items of %s have no node to hold\n", RegexSource(v))
+			}
+			return "", ""
+		}
+		// Separators are matched to step over them but not kept
+		separator := ""
+		if st != "" {
+			separator = fmt.Sprintf("%s s;\nif (!%s(list, i, s)) break;", st, sm)
+		}
+		dangling := "i = start;"
+		if v.Trailing {
+			dangling = ""
+		}
+		typ := fmt.Sprintf("std::vector<%s>", t)
+		name := a.matcher()
+		a.matchers.WriteString(fmt.Sprintf(
+			`
+			static bool %s(const Nodes &list, size_t &i, %s &out) {
+				auto first = i;
+				%s v;
+				if (!%s(list, i, v)) {
+					i = first;
+					return false;
+				}
+				out.push_back(std::move(v));
+				for (;;) {
+					auto start = i;
+					%s
+					%s w;
+					if (!%s(list, i, w) || i == start) {
+						%s
+						break;
+					}
+					out.push_back(std::move(w));
+				}
+				return true;
+			}
+			`,
+			name,
+			typ,
+			t,
+			m,
+			separator,
+			t,
+			m,
+			dangling,
+		))
+		return typ, name
+	case *OptionalRegex:
+		t, m := a.shape(v.Inner)
+		if t == "" {
+			return "", ""
+		}
+		typ := fmt.Sprintf("std::optional<%s>", t)
+		name := a.matcher()
+		a.matchers.WriteString(fmt.Sprintf(
+			`
+			static bool %s(const Nodes &list, size_t &i, %s &out) {
+				%s v;
+				if (%s(list, i, v))
+					out = std::move(v);
+				return true;
+			}
+			`,
+			name,
+			typ,
+			t,
+			m,
+		))
+		return typ, name
+	default:
+		return "", ""
+	}
+}
+
+// ConstructToCppAst generates the construct's class in `chisel::ast`, split
+// into the class itself and the definitions of its matchers and members.
+func (c *Construct) ConstructToCppAst() (string, string) {
+	a := &astClass{construct: c}
+
+	var decls strings.Builder
+	top := ""
+	switch v := c.astShape().(type) {
+	case *ChainRegex:
+		top = fmt.Sprintf("%s(list, i, *result)", a.fields(v.Chain, c.Name, &decls))
+	case *OrRegex:
+		t, m := a.choice(v, true)
+		if t == "" {
+			top = "true"
+			break
+		}
+		decls.WriteString(fmt.Sprintf("%s value;\n", t))
+		top = fmt.Sprintf("%s(list, i, result->value)", m)
+	default:
+		top = fmt.Sprintf("%s(list, i, *result)", a.fields([]Regex{v}, c.Name, &decls))
+	}
+
+	recovered := ""
+	if c.Recover != nil {
+		recovered = `
+		if (node.holds_node() && node.get_node() && node.get_node()->get_type() == Parser::ParseNode::Type::ERROR) {
+			out = nullptr;
+			return true;
+		}
+		`
+	}
+	// Precedence climbing uses a lone operand as is
+	other := "return false;"
+	if c.Precedence != nil {
+		other = fmt.Sprintf(
+			`
+			list.push_back(&node);
+			auto result = std::make_shared<%s>();
+			size_t i = 0;
+			%s
+			out = result;
+			return true;
+			`,
+			c.Name,
+			a.operand,
+		)
+	}
+
+	class := fmt.Sprintf(
+		`
+		struct %s {
+			%s
+			%s
+			// Null when node is not a %s, or is the error node of one that
+			// recovered.
+			static std::shared_ptr<%s> build(const Parser::Node &node);
+			static bool match(const Parser::Node &node, std::shared_ptr<%s> &out);
+		};
+		`,
+		c.Name,
+		a.structs.String(),
+		decls.String(),
+		c.Name,
+		c.Name,
+		c.Name,
+	)
+
+	definitions := fmt.Sprintf(
+		`
+		%s
+		bool %s::match(const Parser::Node &node, std::shared_ptr<%s> &out) {
+			%s
+			Nodes list;
+			if (node.holds_node() && node.get_node() && node.get_node()->get_type() == Parser::ParseNode::Type::%s) {
+				for (auto &child : node.get_node()->get_children())
+					list.push_back(&child);
+			} else {
+				%s
+			}
+
+			auto result = std::make_shared<%s>();
+			size_t i = 0;
+			if (!(%s) || i != list.size())
+				return false;
+			out = result;
+			return true;
+		}
+
+		std::shared_ptr<%s> %s::build(const Parser::Node &node) {
+			std::shared_ptr<%s> out;
+			match(node, out);
+			return out;
+		}
+		`,
+		a.matchers.String(),
+		c.Name, c.Name,
+		recovered,
+		c.Name,
+		other,
+		c.Name,
+		top,
+		c.Name, c.Name,
+		c.Name,
+	)
+	return class, definitions
+}
@@ -0,0 +1,315 @@
+package chisel
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+type builtinToken struct {
+	Args []string
+	Code string
+}
+
+// Built in token bodies. Each one reads from `reader` and finishes through
+// {{.Accept}} with the token data in `buf`, or through {{.Reject}} which
+// rewinds to `start`.
+var builtinTokens = map[string]builtinToken{
+	"identifier": {
+		Code: `(std::istream &reader) {
+			auto start = reader.tellg();
+			std::string buf;
+			int c = reader.peek();
+			if (c == std::char_traits<char>::eof() || !(c >= 0x80 || std::isalpha(c) || c == '_'))
+				{{.Reject}}
+			while ((c = reader.peek()) != std::char_traits<char>::eof() && (c >= 0x80 || std::isalnum(c) || c == '_'))
+				buf.push_back(reader.get());
+			reader.clear();
+			{{.Accept}}
+		}`,
+	},
+
+	"integer": {
+		Code: `(std::istream &reader) {
+			auto start = reader.tellg();
+			std::string buf;
+			for (int c = reader.peek(); c != std::char_traits<char>::eof() && std::isdigit(c); c = reader.peek())
+				buf.push_back(reader.get());
+			reader.clear();
+			if (buf.empty())
+				{{.Reject}}
+			{{.Accept}}
+		}`,
+	},
+
+	// @float needs a fraction or an exponent, @number takes integers too.
+	"float":  {Code: numberCode},
+	"number": {Code: numberCode},
+
+	"string": {
+		Args: []string{`"\""`},
+		Code: `(std::istream &reader) {
+			auto start = reader.tellg();
+			std::string buf;
+			if (reader.peek() != {{index .Args 0}}[0])
+				{{.Reject}}
+			reader.get();
+			for (;;) {
+				int c = reader.get();
+				if (c == std::char_traits<char>::eof())
+					{{.Reject}}
+				if (c == {{index .Args 0}}[0])
+					break;
+				if (c == '\\') {
+					switch (c = reader.get()) {
+					case std::char_traits<char>::eof():
+						{{.Reject}}
+					case 'n': c = '\n'; break;
+					case 't': c = '\t'; break;
+					case 'r': c = '\r'; break;
+					case '0': c = '\0'; break;
+					default: break;
+					}
+				}
+				buf.push_back(c);
+			}
+			{{.Accept}}
+		}`,
+	},
+
+	"whitespace": {
+		Code: `(std::istream &reader) {
+			auto start = reader.tellg();
+			std::string buf;
+			for (int c = reader.peek(); c != std::char_traits<char>::eof() && std::isspace(c); c = reader.peek())
+				buf.push_back(reader.get());
+			reader.clear();
+			if (buf.empty())
+				{{.Reject}}
+			{{.Accept}}
+		}`,
+	},
+
+	"line_comment": {
+		Args: []string{`"//"`},
+		Code: `(std::istream &reader) {
+			auto start = reader.tellg();
+			std::string buf;
+			for (const char *p = {{index .Args 0}}; *p; ++p)
+				if (reader.get() != *p)
+					{{.Reject}}
+			for (int c = reader.peek(); c != std::char_traits<char>::eof() && c != '\n'; c = reader.peek())
+				buf.push_back(reader.get());
+			reader.clear();
+			{{.Accept}}
+		}`,
+	},
+
+	"block_comment": {
+		Args: []string{`"/*"`, `"*/"`},
+		Code: `(std::istream &reader) {
+			auto start = reader.tellg();
+			std::string buf;
+			for (const char *p = {{index .Args 0}}; *p; ++p)
+				if (reader.get() != *p)
+					{{.Reject}}
+			const std::string close = {{index .Args 1}};
+			for (;;) {
+				int c = reader.get();
+				if (c == std::char_traits<char>::eof())
+					{{.Reject}}
+				buf.push_back(c);
+				if (buf.size() >= close.size() && buf.compare(buf.size() - close.size(), close.size(), close) == 0) {
+					buf.resize(buf.size() - close.size());
+					break;
+				}
+			}
+			{{.Accept}}
+		}`,
+	},
+
+	// The layout tokens take the NEWLINE, INDENT and DEDENT found by
+	// Token::scan_layout where the parse stands.
+	"newline": {Code: layoutCode("NEWLINE")},
+	"indent":  {Code: layoutCode("INDENT")},
+	"dedent":  {Code: layoutCode("DEDENT")},
+}
+
+func layoutCode(kind string) string {
+	return `(std::istream &reader) {
+		auto start = reader.tellg();
+		std::string buf;
+		if (!Token::take_layout(reader, Token::Layout::` + kind + `))
+			{{.Reject}}
+		{{.Accept}}
+	}`
+}
+
+const numberCode = `(std::istream &reader) {
+	auto start = reader.tellg();
+	std::string buf;
+	auto digits = [&]() {
+		size_t n = 0;
+		for (int c = reader.peek(); c != std::char_traits<char>::eof() && std::isdigit(c); c = reader.peek(), ++n)
+			buf.push_back(reader.get());
+		reader.clear();
+		return n;
+	};
+
+	if (!digits())
+		{{.Reject}}
+	// A '.' or exponent not followed by digits is left for the next token
+	bool real = false;
+	auto mark = reader.tellg();
+	auto size = buf.size();
+	if (reader.peek() == '.') {
+		buf.push_back(reader.get());
+		if (digits()) {
+			real = true;
+		} else {
+			reader.seekg(mark, std::ios::beg);
+			buf.resize(size);
+		}
+	}
+	reader.clear();
+	mark = reader.tellg();
+	size = buf.size();
+	if (reader.peek() == 'e' || reader.peek() == 'E') {
+		buf.push_back(reader.get());
+		if (reader.peek() == '+' || reader.peek() == '-')
+			buf.push_back(reader.get());
+		if (digits()) {
+			real = true;
+		} else {
+			reader.clear();
+			reader.seekg(mark, std::ios::beg);
+			buf.resize(size);
+		}
+	}
+	reader.clear();
+	{{if eq .Kind "float"}}
+	if (!real)
+		{{.Reject}}
+	{{end}}
+	{{.Accept}}
+}`
+
+// createBuiltinToken reads `@kind` or `@kind("arg", ...)` and expands it into
+// a FunctionToken named `name`.
+func createBuiltinToken(r *bufio.Reader, name string, precedence int, skip bool) (Token, error) {
+	if err := skipWhitespace(r); err != nil {
+		return nil, err
+	}
+	if b, err := r.ReadByte(); err != nil || b != '@' {
+		return nil, fmt.Errorf("Expected '@' before a built in token")
+	}
+
+	kind, err := syntaxReader(r)()
+	if err != nil {
+		return nil, err
+	}
+	builtin, ok := builtinTokens[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown built in token: '@%s'", kind)
+	}
+	layout := ""
+	if kind == "newline" || kind == "indent" || kind == "dedent" {
+		layout = kind
+	}
+	if layout != "" && skip {
+		return nil, fmt.Errorf("@%s: the layout cannot be skipped", kind)
+	}
+
+	args := []string{}
+	if b, err := r.Peek(1); err == nil && b[0] == '(' {
+		r.Discard(1)
+		for {
+			arg, err := stringReader(r)()
+			if err != nil {
+				return nil, fmt.Errorf("@%s: %v", kind, err)
+			}
+			args = append(args, strconv.Quote(arg))
+
+			if err := skipWhitespace(r); err != nil {
+				return nil, err
+			}
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == ')' {
+				break
+			}
+			if b != ',' {
+				return nil, fmt.Errorf("@%s: expected ',' or ')', got '%c'", kind, b)
+			}
+		}
+	}
+	if len(args) > len(builtin.Args) {
+		return nil, fmt.Errorf("@%s takes at most %d arguments", kind, len(builtin.Args))
+	}
+	args = append(args, builtin.Args[len(args):]...)
+
+	accept := fmt.Sprintf("return Token::make(Token::Type::%s, buf);", name)
+	reject := "{ reader.clear(); reader.seekg(start, std::ios::beg); return Token::failed; }"
+	if skip {
+		accept = "return;"
+		reject = "{ reader.clear(); reader.seekg(start, std::ios::beg); return; }"
+	}
+
+	var code strings.Builder
+	templ := template.Must(template.New("").Parse(builtin.Code))
+	err = templ.Execute(&code, map[string]any{
+		"Kind":   kind,
+		"Args":   args,
+		"Accept": accept,
+		"Reject": reject,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return FunctionToken{
+		Name:       name,
+		Code:       code.String(),
+		Precedence: precedence,
+		Identifier: kind == "identifier",
+		Layout:     layout,
+	}, nil
+}
+
+// layout reports whether any token is a layout one, and which of NEWLINE and
+// INDENT with DEDENT are.
+func (d *ChiselData) layout() (layout, newlines, indents bool) {
+	for _, token := range d.Tokens {
+		if v, ok := token.(FunctionToken); ok && v.Layout != "" {
+			layout = true
+			newlines = newlines || v.Layout == "newline"
+			indents = indents || v.Layout != "newline"
+		}
+	}
+	return layout, newlines, indents
+}
+
+// CheckLayout makes sure INDENT comes with DEDENT, each declared once.
+func (d *ChiselData) CheckLayout() error {
+	found := map[string]string{}
+	for _, token := range d.Tokens {
+		v, ok := token.(FunctionToken)
+		if !ok || v.Layout == "" {
+			continue
+		}
+		if other, ok := found[v.Layout]; ok {
+			return fmt.Errorf("@%s: tokens %s and %s both take it", v.Layout, other, v.Name)
+		}
+		found[v.Layout] = v.Name
+	}
+	_, indent := found["indent"]
+	_, dedent := found["dedent"]
+	if indent != dedent {
+		return fmt.Errorf("@indent and @dedent must be declared together")
+	}
+	return nil
+}
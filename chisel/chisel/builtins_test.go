@@ -0,0 +1,363 @@
+package chisel
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func expandBuiltin(source, name string, skip bool) (FunctionToken, error) {
+	token, err := createBuiltinToken(bufio.NewReader(strings.NewReader(source)), name, 0, skip)
+	if err != nil {
+		return FunctionToken{}, err
+	}
+	return token.(FunctionToken), nil
+}
+
+func TestBuiltinTokens(t *testing.T) {
+	tests := []struct {
+		source     string
+		contains   []string
+		excludes   []string
+		identifier bool
+	}{
+		{
+			source:     "@identifier",
+			contains:   []string{"std::isalpha(c) || c == '_'", "std::isalnum(c) || c == '_'", "c >= 0x80"},
+			identifier: true,
+		},
+		{
+			source:   "@integer",
+			contains: []string{"std::isdigit(c)", "if (buf.empty())"},
+		},
+		{
+			source:   "@float",
+			contains: []string{"if (reader.peek() == '.')", "reader.peek() == 'e'", "if (!real)"},
+		},
+		{
+			source:   "@number",
+			contains: []string{"if (reader.peek() == '.')", "reader.peek() == 'e'"},
+			excludes: []string{"if (!real)"},
+		},
+		{
+			source: "@string",
+			contains: []string{
+				`reader.peek() != "\""[0]`,
+				`c == "\""[0]`,
+				`case 'n': c = '\n'; break;`,
+				`case 't': c = '\t'; break;`,
+				`case 'r': c = '\r'; break;`,
+				`case '0': c = '\0'; break;`,
+				"default: break;",
+			},
+		},
+		{
+			source:   `@string('\'')`,
+			contains: []string{`reader.peek() != "'"[0]`, `c == "'"[0]`, `case 'n': c = '\n'; break;`},
+		},
+		{
+			source:   "@whitespace",
+			contains: []string{"std::isspace(c)", "if (buf.empty())"},
+		},
+		{
+			source:   "@line_comment",
+			contains: []string{`const char *p = "//"`, "c != '\\n'"},
+		},
+		{
+			source:   `@line_comment("#")`,
+			contains: []string{`const char *p = "#"`},
+			excludes: []string{`"//"`},
+		},
+		{
+			source:   "@block_comment",
+			contains: []string{`const char *p = "/*"`, `const std::string close = "*/"`},
+		},
+		{
+			source:   `@block_comment("(*", "*)")`,
+			contains: []string{`const char *p = "(*"`, `const std::string close = "*)"`},
+		},
+		{
+			source:   `@block_comment("{-")`,
+			contains: []string{`const char *p = "{-"`, `const std::string close = "*/"`},
+		},
+	}
+
+	for _, test := range tests {
+		token, err := expandBuiltin(test.source, "NAME", false)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if token.Name != "NAME" {
+			t.Errorf("%s: named %s, want NAME", test.source, token.Name)
+		}
+		if token.Identifier != test.identifier {
+			t.Errorf("%s: Identifier is %v, want %v", test.source, token.Identifier, test.identifier)
+		}
+		if strings.Contains(token.Code, "{{") {
+			t.Errorf("%s: template left unexpanded:\n%s", test.source, token.Code)
+		}
+		if !strings.Contains(token.Code, "return Token::make(Token::Type::NAME, buf);") {
+			t.Errorf("%s: does not accept as a NAME token:\n%s", test.source, token.Code)
+		}
+		if !strings.Contains(token.Code, "reader.seekg(start, std::ios::beg); return Token::failed;") {
+			t.Errorf("%s: does not rewind when rejecting:\n%s", test.source, token.Code)
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(token.Code, s) {
+				t.Errorf("%s: expected %s in:\n%s", test.source, s, token.Code)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(token.Code, s) {
+				t.Errorf("%s: unexpected %s in:\n%s", test.source, s, token.Code)
+			}
+		}
+	}
+}
+
+func TestBuiltinSkipToken(t *testing.T) {
+	token, err := expandBuiltin("@whitespace", "WS", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token.Code, "Token::make") || strings.Contains(token.Code, "Token::failed") {
+		t.Errorf("skip token returns a token:\n%s", token.Code)
+	}
+	if !strings.Contains(token.Code, "reader.seekg(start, std::ios::beg); return; }") {
+		t.Errorf("skip token does not rewind when rejecting:\n%s", token.Code)
+	}
+}
+
+func TestBuiltinTokenErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"identifier", "Expected '@'"},
+		{"@nothing", "unknown built in token: '@nothing'"},
+		{"@line_comment()", "@line_comment:"},
+		{"@line_comment(#)", "@line_comment:"},
+		{`@line_comment("#"`, "@line_comment:"},
+		{`@line_comment("#" "x")`, "@line_comment: expected ',' or ')'"},
+		{`@line_comment("#", "x")`, "@line_comment takes at most 1 arguments"},
+		{`@block_comment("a", "b", "c")`, "@block_comment takes at most 2 arguments"},
+		{`@integer("0")`, "@integer takes at most 0 arguments"},
+		{`@string("\")`, "@string:"},
+	}
+
+	for _, test := range tests {
+		_, err := expandBuiltin(test.source, "NAME", false)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.source)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %q, want one containing %q", test.source, err, test.err)
+		}
+	}
+}
+
+const builtinGrammar = `
+PROGRAM = (ID | INT | FLT | NUM | STR | SQ | WS | LC | HC | BC | PC)*;
+tok (
+    ID = @identifier
+    INT = @integer
+    FLT = @float
+    NUM = @number
+    STR = @string
+    SQ = @string('\'')
+    WS = @whitespace
+    LC = @line_comment
+    HC = @line_comment("#")
+    BC = @block_comment
+    PC = @block_comment("(*", "*)")
+)
+`
+
+// builtinDriver lexes each `NAME input` pair of its arguments with token
+// NAME, printing `ok [text] end` with where it stopped, or `fail end`.
+func builtinDriver(names []string) string {
+	var calls strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&calls, "if (name == %q) token = Token::token_%s(in);\n", name, name)
+	}
+	return `#include "out.hpp"
+#include <sstream>
+using namespace chisel;
+int main(int argc, char **argv) {
+	for (int i = 1; i + 1 < argc; i += 2) {
+		std::string name = argv[i];
+		std::istringstream in(argv[i + 1]);
+		Token token = Token::failed;
+		` + calls.String() + `
+		in.clear();
+		if (!token) {
+			std::cout << "fail " << in.tellg() << "\n";
+			continue;
+		}
+		std::cout << "ok [";
+		for (const char *c = token.get_data(); *c; ++c) {
+			if (*c == '\n') std::cout << "\\n";
+			else if (*c == '\t') std::cout << "\\t";
+			else std::cout << *c;
+		}
+		std::cout << "] " << in.tellg() << "\n";
+	}
+}
+`
+}
+
+func TestBuiltinTokensLex(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"ID", "abc1 x", "ok [abc1] 4"},
+		{"ID", "_x", "ok [_x] 2"},
+		{"ID", "h\u00e9llo", "ok [h\u00e9llo] 6"},
+		{"ID", "1a", "fail 0"},
+
+		{"INT", "123x", "ok [123] 3"},
+		{"INT", "x", "fail 0"},
+		{"INT", "", "fail 0"},
+
+		{"FLT", "1.5", "ok [1.5] 3"},
+		{"FLT", "2.5e-3;", "ok [2.5e-3] 6"},
+		{"FLT", "1e5", "ok [1e5] 3"},
+		{"FLT", "1e", "fail 0"},
+		{"FLT", "1.", "fail 0"},
+		{"FLT", "12", "fail 0"},
+
+		{"NUM", "12", "ok [12] 2"},
+		{"NUM", "3.25", "ok [3.25] 4"},
+		{"NUM", "1e", "ok [1] 1"},
+		{"NUM", "1e+", "ok [1] 1"},
+		{"NUM", "1.x", "ok [1] 1"},
+		{"NUM", ".5", "fail 0"},
+
+		{"STR", `"abc" x`, "ok [abc] 5"},
+		{"STR", `"a\nb\tc"`, "ok [a\\nb\\tc] 9"},
+		{"STR", `"a\"b"`, `ok [a"b] 6`},
+		{"STR", `""`, "ok [] 2"},
+		{"STR", `"abc`, "fail 0"},
+		{"STR", `"abc\`, "fail 0"},
+		{"STR", `'abc'`, "fail 0"},
+
+		{"SQ", `'it\'s'`, "ok [it's] 7"},
+		{"SQ", `"abc"`, "fail 0"},
+
+		{"WS", " \t\nx", "ok [ \\t\\n] 3"},
+		{"WS", "x", "fail 0"},
+
+		{"LC", "// hi\nx", "ok [ hi] 5"},
+		{"LC", "//", "ok [] 2"},
+		{"LC", "/x", "fail 0"},
+		{"LC", "# hi", "fail 0"},
+
+		{"HC", "# hi\n", "ok [ hi] 4"},
+		{"HC", "// hi", "fail 0"},
+
+		{"BC", "/* a */x", "ok [ a ] 7"},
+		{"BC", "/* a\n b */", "ok [ a\\n b ] 10"},
+		{"BC", "/**/", "ok [] 4"},
+		// Block comments do not nest: the first close ends one
+		{"BC", "/* a /* b */ c */", "ok [ a /* b ] 12"},
+		{"BC", "/* a", "fail 0"},
+		{"BC", "/* a *", "fail 0"},
+		{"BC", "(* a *)", "fail 0"},
+
+		{"PC", "(* a *)", "ok [ a ] 7"},
+		{"PC", "(* a */", "fail 0"},
+	}
+
+	names := []string{"ID", "INT", "FLT", "NUM", "STR", "SQ", "WS", "LC", "HC", "BC", "PC"}
+	program := buildParser(t, builtinGrammar, builtinDriver(names), Options{})
+
+	args := []string{}
+	for _, test := range tests {
+		args = append(args, test.name, test.input)
+	}
+	got := runParser(t, program, args...)
+	if len(got) != len(tests) {
+		t.Fatalf("got %d results for %d samples:\n%s", len(got), len(tests), strings.Join(got, "\n"))
+	}
+	for i, test := range tests {
+		if got[i] != test.want {
+			t.Errorf("%s %q: got %s, want %s", test.name, test.input, got[i], test.want)
+		}
+	}
+}
+
+// Backtracking over an alternative that took an INDENT or DEDENT must give it
+// back for the next alternative, though neither moves through the input.
+func TestLayoutChoices(t *testing.T) {
+	grammar := `
+PROGRAM = STMT*;
+STMT = ID COLON NL BLOCK | ID NL;
+BLOCK = INDENT ID EQ ID NL REST | INDENT ID NL REST;
+REST = DEDENT ID EQ ID NL | DEDENT;
+tok (
+    COLON = ":"
+    EQ = "="
+    ID = @identifier
+    NL = @newline
+    INDENT = @indent
+    DEDENT = @dedent
+)
+skip WS = @whitespace
+`
+	driver := `#include "out.hpp"
+#include <sstream>
+using namespace chisel;
+// Prints the tree, with _ for tokens holding no text
+void show(const Parser::Node &node) {
+	if (node.holds_token()) {
+		auto data = node.get_token().get_data();
+		std::cout << " " << (data && *data ? data : "_");
+		return;
+	}
+	std::cout << " (";
+	for (auto &child : node.get_node()->get_children())
+		show(child);
+	std::cout << ")";
+}
+int main(int argc, char **argv) {
+	for (int i = 1; i < argc; ++i) {
+		std::istringstream in(argv[i]);
+		auto program = Parser::construct_PROGRAM(in);
+		if (!program || Parser::last_error()) {
+			std::cout << Parser::last_error().message() << "\n";
+			continue;
+		}
+		show(program);
+		std::cout << "\n";
+	}
+}
+`
+	tests := []struct {
+		input, want string
+	}{
+		// The first alternatives of BLOCK and of REST fail past their layout
+		// token
+		{"a:\n  b\nc\n", " ( ( a _ _ ( _ b _ ( _))) ( c _))"},
+		{"a:\n  b = c\nd\n", " ( ( a _ _ ( _ b _ c _ ( _))) ( d _))"},
+		{"a:\n  b\nc = d\n", " ( ( a _ _ ( _ b _ ( _ c _ d _))))"},
+		{"a:\n  b\n  c\n", "line 3:3: expected DEDENT, found 'c'"},
+	}
+
+	program := buildParser(t, grammar, driver, Options{})
+	args := []string{}
+	for _, test := range tests {
+		args = append(args, test.input)
+	}
+	got := runParser(t, program, args...)
+	if len(got) != len(tests) {
+		t.Fatalf("got %d results for %d inputs:\n%s", len(got), len(tests), strings.Join(got, "\n"))
+	}
+	for i, test := range tests {
+		if got[i] != test.want {
+			t.Errorf("%q: got %s, want %s", test.input, got[i], test.want)
+		}
+	}
+}
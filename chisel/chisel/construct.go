@@ -2,6 +2,7 @@ package chisel
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -14,13 +15,57 @@ func (c *ConstructRefRegex) String() string {
 }
 
 type SimpleConstruct struct {
-	Name  string
-	Value string
+	Name   string
+	Value  string
+	Type   string
+	Action string
+	Inline bool
+
+	// Params names the parameters of a rule template.
+	Params []string
+
+	// Skip names the tokens skipped while matching the construct, in place
+	// of the skip tokens. NoSkip skips nothing.
+	Skip   []string
+	NoSkip bool
+
+	// Lexical constructs match character by character into a token.
+	Lexical bool
 }
 
 type Construct struct {
 	Name  string
 	Value Regex
+
+	// Inline constructs splice their children into the parent's instead of
+	// adding a node of their own.
+	Inline bool
+
+	// Action is C++ run on each node the construct builds, where `$$` is
+	// the node's result of type Type.
+	Action string
+	Type   string
+
+	// Recover is the token skipped to when the construct fails, or nil.
+	Recover Token
+
+	// Skip replaces the skip tokens while the construct, and every one it
+	// uses, is matched: by these tokens, or by nothing with NoSkip.
+	Skip   []Token
+	NoSkip bool
+
+	// Lexical constructs skip nothing once started, and add a token of their
+	// name holding the text matched instead of a node.
+	Lexical bool
+
+	// Precedence makes the construct an operator expression over Value.
+	Precedence *PrecedenceTable
+
+	// Tail is set by EliminateLeftRecursion: after Value matches, every match
+	// of Tail wraps the node built so far as the first child of a new one,
+	// labelled TailLabel.
+	Tail      Regex
+	TailLabel string
 }
 
 var prototypedConstructs = map[string]bool{}
@@ -32,22 +77,123 @@ func (c *Construct) ConstructToCppFunction() string {
 	}
 
 	createdConstructs[c.Name] = true
+	if c.Precedence != nil {
+		return c.precedenceToCppFunction()
+	}
+
+	// The body matches the construct into `node`, setting `success`.
+	body := fmt.Sprintf(
+		`
+		Node node(new ParseNode(ParseNode::Type::%s));
+		bool success = %s;
+		`,
+		c.Name,
+		RegexCall(c.Value, "reader", "node.get_node()->get_children()"),
+	)
+	if c.Lexical {
+		body = c.lexicalBody()
+	} else if c.Tail != nil {
+		body = c.leftFoldBody()
+	} else if c.Action != "" {
+		body += fmt.Sprintf("if (success) Parser::action_%s(*node.get_node());", c.Name)
+	}
+
+	prelude := c.skipPrologue()
+	if c.Lexical {
+		// Whatever comes before is skipped as before a token
+		prelude = "Parser::skip(reader);\n" + prelude
+	}
+	body += c.skipEpilogue()
+	recovery := ""
+	if c.Recover != nil {
+		prelude += "auto start = Parser::mark(reader);"
+		recovery = fmt.Sprintf(
+			`
+			if (!success && Parser::recover(reader, start, &%s)) {
+				Parser::leave(reader, true);
+				return Node(new ParseNode(ParseNode::Type::ERROR));
+			}
+			`,
+			TokenFunction(c.Recover),
+		)
+	}
+
 	return fmt.Sprintf(
 		`
 		Parser::Node Parser::construct_%s(std::istream &reader) {
-			Node node(new ParseNode(ParseNode::Type::%s));
-			if (!%s) {
+			Parser::enter(reader);
+			%s
+			%s
+			%s
+			Parser::leave(reader, success);
+			if (!success) {
 				return Node::failed;
 			}
 			return node;
 		}
 		`,
 		c.Name,
-		c.Name,
-		RegexCall(c.Value, "reader", "node.get_node()->get_children()"),
+		prelude,
+		body,
+		recovery,
 	)
 }
 
+// skipFunction names the Parser::skip_* function skipping what the
+// construct skips, or is empty for the skip tokens.
+func (c *Construct) skipFunction() string {
+	if c.NoSkip || c.Lexical {
+		return "skip_nothing"
+	}
+	if len(c.Skip) == 0 {
+		return ""
+	}
+	names := []string{}
+	for _, token := range c.Skip {
+		names = append(names, TokenName(token))
+	}
+	return "skip_" + strings.Join(names, "_")
+}
+
+// SkipToCppFunction defines the construct's skip function, unless another
+// construct skipping the same did.
+func (c *Construct) SkipToCppFunction(defined map[string]bool) (string, string) {
+	name := c.skipFunction()
+	if name == "" || defined[name] {
+		return "", ""
+	}
+	defined[name] = true
+
+	var calls strings.Builder
+	for _, token := range c.Skip {
+		calls.WriteString(TokenCall(token, "reader"))
+		calls.WriteString(";\n")
+	}
+	return fmt.Sprintf("static void %s(std::istream &reader);\n", name), fmt.Sprintf(
+		`
+		void Parser::%s(std::istream &reader) {
+			%s
+		}
+		`,
+		name,
+		calls.String(),
+	)
+}
+
+func (c *Construct) skipPrologue() string {
+	if name := c.skipFunction(); name != "" {
+		return fmt.Sprintf("auto skipper = Parser::skipper;\nParser::skipper = &Parser::%s;\n", name)
+	}
+	return ""
+}
+
+func (c *Construct) skipEpilogue() string {
+	if c.skipFunction() != "" {
+		return "\nParser::skipper = skipper;\n"
+	}
+	return ""
+}
+
 func (c *Construct) ConstructToCppPrototype() string {
 	if _, ok := prototypedConstructs[c.Name]; ok {
 		return ""
@@ -57,6 +203,213 @@ func (c *Construct) ConstructToCppPrototype() string {
 	return fmt.Sprintf("static Node %s;", c.Call("std::istream &"))
 }
 
+// viewReserved are the members of a NAME_view that accessors would hide.
+var viewReserved = map[string]bool{
+	"node":     true,
+	"get_node": true,
+}
+
+// ConstructToCppView generates a Parser::NAME_view over the construct's
+// ParseNode with an accessor per label in its rule. Labels matching at most
+// one node return it or nullptr, others return every node they matched. A
+// construct may give a bare token, as a precedence construct does when no
+// operator applies, in which case the view has no node and finds nothing.
+func (c *Construct) ConstructToCppView() string {
+	if c.Lexical {
+		return ""
+	}
+	labels := []string{}
+	collectLabels(c.Value, &labels)
+	collectLabels(c.Tail, &labels)
+	if c.TailLabel != "" {
+		collectLabels(&LabelRegex{Label: c.TailLabel}, &labels)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var accessors strings.Builder
+	for _, label := range labels {
+		// Labels that are C++ keywords or members of the view are suffixed
+		// with '_', as AST fields are
+		name := label
+		if cppReserved[name] || viewReserved[name] {
+			name += "_"
+		}
+
+		// A node of a left folded construct matches either Value, or the
+		// labelled previous node and Tail
+		count := labelCount(c.Value, label)
+		if c.Tail != nil {
+			tail := labelCount(c.Tail, label)
+			if label == c.TailLabel {
+				tail++
+			}
+			count = max(count, min(tail, 2))
+		}
+		if count <= 1 {
+			accessors.WriteString(fmt.Sprintf(
+				"const Node *%s() const { return node ? node->find(%s) : nullptr; }\n",
+				name,
+				strconv.Quote(label),
+			))
+		} else {
+			accessors.WriteString(fmt.Sprintf(
+				"std::vector<const Node *> %s() const { return node ? node->find_all(%s) : std::vector<const Node *>(); }\n",
+				name,
+				strconv.Quote(label),
+			))
+		}
+	}
+
+	return fmt.Sprintf(
+		`
+		class %s_view {
+			const ParseNode *node;
+		public:
+			%s_view(const Node &node) : node(node.holds_node() ? node.get_node() : nullptr) {}
+			%s_view(const ParseNode *node) : node(node) {}
+
+			const ParseNode *get_node() const { return node; }
+
+			%s
+		};
+		`,
+		c.Name,
+		c.Name,
+		c.Name,
+		accessors.String(),
+	)
+}
+
+// collectLabels appends the labels used in r to labels in order of first use.
+// Labels inside a labelled regex are overwritten by the outer one.
+func collectLabels(r Regex, labels *[]string) {
+	switch v := r.(type) {
+	case *LabelRegex:
+		for _, label := range *labels {
+			if label == v.Label {
+				return
+			}
+		}
+		*labels = append(*labels, v.Label)
+	case *ChainRegex:
+		for _, re := range v.Chain {
+			collectLabels(re, labels)
+		}
+	case *OrRegex:
+		for _, re := range v.Chain {
+			collectLabels(re, labels)
+		}
+	case *CapturedRegex:
+		collectLabels(v.Inner, labels)
+	case *MultiplierRegex:
+		collectLabels(v.Inner, labels)
+	case *OptionalRegex:
+		collectLabels(v.Inner, labels)
+	case *BoundedRegex:
+		collectLabels(v.Inner, labels)
+	case *SeparatedRegex:
+		collectLabels(v.Item, labels)
+		collectLabels(v.Separator, labels)
+	case *NestedRegex:
+		if v.Construct.Inline {
+			collectLabels(v.Construct.Value, labels)
+		}
+	}
+}
+
+// labelCount is how many nodes a match of r can label `label`: 0, 1, or 2
+// for more than one.
+func labelCount(r Regex, label string) int {
+	switch v := r.(type) {
+	case *LabelRegex:
+		if v.Label != label {
+			return 0
+		}
+		if matchesOne(v.Inner) {
+			return 1
+		}
+		return 2
+	case *ChainRegex:
+		n := 0
+		for _, re := range v.Chain {
+			n += labelCount(re, label)
+		}
+		return min(n, 2)
+	case *OrRegex:
+		n := 0
+		for _, re := range v.Chain {
+			n = max(n, labelCount(re, label))
+		}
+		return n
+	case *CapturedRegex:
+		return labelCount(v.Inner, label)
+	case *MultiplierRegex:
+		return min(2*labelCount(v.Inner, label), 2)
+	case *OptionalRegex:
+		return labelCount(v.Inner, label)
+	case *BoundedRegex:
+		if v.Max == 1 {
+			return labelCount(v.Inner, label)
+		}
+		return min(2*labelCount(v.Inner, label), 2)
+	case *SeparatedRegex:
+		return min(2*(labelCount(v.Item, label)+labelCount(v.Separator, label)), 2)
+	case *NestedRegex:
+		if v.Construct.Inline {
+			return labelCount(v.Construct.Value, label)
+		}
+		return 0
+	default:
+		return 0
+	}
+}
+
+func matchesOne(r Regex) bool {
+	switch v := r.(type) {
+	case *UnitRegex:
+		return true
+	case *NestedRegex:
+		return !v.Construct.Inline
+	case *CapturedRegex:
+		return matchesOne(v.Inner)
+	case *OptionalRegex:
+		return matchesOne(v.Inner)
+	default:
+		return false
+	}
+}
+
+func (c *Construct) ActionToCppPrototype() string {
+	if c.Action == "" {
+		return ""
+	}
+	return fmt.Sprintf("static void action_%s(ParseNode &node);\n", c.Name)
+}
+
+func (c *Construct) ActionToCppFunction() string {
+	if c.Action == "" {
+		return ""
+	}
+
+	code := c.Action
+	if c.Type != "" {
+		code = strings.ReplaceAll(code, "$$", fmt.Sprintf("node.result<%s>()", valueTypes[c.Type]))
+	}
+	return fmt.Sprintf(
+		`
+		void Parser::action_%s(ParseNode &node) {
+			auto &children = node.get_children();
+			(void)children;
+			%s
+		}
+		`,
+		c.Name,
+		code,
+	)
+}
+
 func (c *Construct) Call(args ...string) string {
 	return fmt.Sprintf("construct_%s(%s)", c.Name, strings.Join(args, ","))
 }
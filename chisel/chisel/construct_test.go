@@ -0,0 +1,43 @@
+package chisel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestViewLabels(t *testing.T) {
+	grammar := `
+PROGRAM = node:ID class:ID get_node:ID build:ID?;
+E = v:ID;
+precedence E {
+    infix left 10 PLUS;
+}
+tok PLUS = "+"
+tok ID = @identifier
+skip WS = @whitespace
+`
+	driver := `#include "out.hpp"
+#include <sstream>
+using namespace chisel;
+const char *text(const Parser::Node *node) {
+	return node ? node->get_token().get_data() : "null";
+}
+int main(int argc, char **argv) {
+	std::istringstream in(argv[1]);
+	auto program = Parser::construct_PROGRAM(in);
+	Parser::PROGRAM_view view(program);
+	std::cout << text(view.node_()) << " " << text(view.class_()) << " "
+		<< text(view.get_node_()) << " " << text(view.build_()) << "\n";
+
+	// E gives a bare ID when no operator applies
+	std::istringstream operand(argv[2]);
+	auto e = Parser::construct_E(operand);
+	std::cout << (Parser::E_view(e).v() ? "v" : "null") << "\n";
+}
+`
+	program := buildParser(t, grammar, driver, Options{})
+	got := strings.Join(runParser(t, program, "a b c", "x"), "\n")
+	if want := "a b c null\nnull"; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
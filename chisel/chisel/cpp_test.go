@@ -0,0 +1,67 @@
+package chisel
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildParser generates the parser for grammar and compiles driver, which
+// includes it as "out.hpp", returning the program built. The test is skipped
+// without a C++ compiler.
+func buildParser(t *testing.T, grammar, driver string, opts Options) string {
+	t.Helper()
+	compiler := os.Getenv("CXX")
+	if compiler == "" {
+		compiler = "c++"
+	}
+	if _, err := exec.LookPath(compiler); err != nil {
+		t.Skipf("no C++ compiler: %v", err)
+	}
+
+	dir := t.TempDir()
+	grammarPath := filepath.Join(dir, "grammar.chisel")
+	if err := os.WriteFile(grammarPath, []byte(grammar), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	driverPath := filepath.Join(dir, "driver.cpp")
+	if err := os.WriteFile(driverPath, []byte(driver), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(grammarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// Every generation starts from nothing declared, as a run of chisel does
+	prototypedConstructs = map[string]bool{}
+	createdConstructs = map[string]bool{}
+	prototypedTokens = map[string]bool{}
+	createdTokens = map[string]bool{}
+
+	// The templates are read from src/, next to the package
+	t.Chdir("..")
+	if err := ReadAndWriteWithOptions(file, filepath.Join(dir, "out.hpp"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	program := filepath.Join(dir, "driver")
+	out, err := exec.Command(compiler, "-std=c++17", "-o", program, driverPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", compiler, err, out)
+	}
+	return program
+}
+
+// runParser runs a program built by buildParser, returning its output lines.
+func runParser(t *testing.T, program string, args ...string) []string {
+	t.Helper()
+	out, err := exec.Command(program, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", program, err, out)
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+}
@@ -17,6 +17,36 @@ type ChiselData struct {
 
 	SimpleConstructs []SimpleConstruct
 	Constructs       []Construct
+
+	// Templates are the parameterised rules, and Instances the constructs
+	// added for their uses so far.
+	Templates []SimpleConstruct
+	Instances map[string]bool
+
+	// Recoveries maps a construct name to the token it skips to on failure.
+	Recoveries map[string]string
+
+	Precedences []SimplePrecedence
+
+	// Modes are the declared lexer modes besides DEFAULT, and TokenModes
+	// maps the tokens declared in one to its name.
+	Modes      []string
+	TokenModes map[string]string
+
+	// File is the grammar being read, and Origins maps each definition, as
+	// in "construct EXPR" or "token ID", to the grammar making it.
+	File    string
+	Origins map[string]string
+}
+
+// externals reports whether any token is an external one.
+func (d *ChiselData) externals() bool {
+	for _, token := range append(append([]Token{}, d.Tokens...), d.SkipTokens...) {
+		if _, ok := token.(SimpleToken); ok {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *ChiselData) writeTokens(file *os.File) error {
@@ -24,13 +54,19 @@ func (d *ChiselData) writeTokens(file *os.File) error {
 	var protoBuilder strings.Builder
 	var defBuilder strings.Builder
 	for _, token := range d.Tokens {
-		if _, ok := token.(SimpleToken); ok {
-			continue
-		}
-
 		typesBuilder.WriteString(TokenName(token))
 		typesBuilder.WriteString(",\n")
 
+		if d.wrapped(token) {
+			protoBuilder.WriteString(tokenPrototype(token, false, "lex_"+TokenName(token)))
+			protoBuilder.WriteString(fmt.Sprintf("\nstatic Token token_%s(std::istream &);\n", TokenName(token)))
+
+			defBuilder.WriteString(tokenDefinition(token, false, "lex_"+TokenName(token)))
+			defBuilder.WriteString(d.tokenWrapper(token))
+			defBuilder.WriteByte('\n')
+			continue
+		}
+
 		protoBuilder.WriteString(TokenPrototype(token, false))
 		protoBuilder.WriteByte('\n')
 
@@ -48,14 +84,62 @@ func (d *ChiselData) writeTokens(file *os.File) error {
 		defBuilder.WriteString(TokenDefinition(token, true))
 		defBuilder.WriteByte('\n')
 	}
+	for _, name := range d.lexicalNames() {
+		typesBuilder.WriteString(name)
+		typesBuilder.WriteString(",\n")
+	}
+
+	var keywords strings.Builder
+	identifiers := false
+	for _, token := range d.Tokens {
+		switch v := token.(type) {
+		case LiteralToken:
+			// Whatever the mode or layout, and without changing the mode
+			if v.Keyword && d.wrapped(v) {
+				keywords.WriteString(fmt.Sprintf("&Token::lex_%s, ", v.Name))
+			} else if v.Keyword {
+				keywords.WriteString(fmt.Sprintf("&%s, ", TokenFunction(v)))
+			}
+		case FunctionToken:
+			identifiers = identifiers || v.Identifier
+		}
+	}
+	if identifiers {
+		protoBuilder.WriteString("static bool is_keyword(std::istream &reader, std::streampos start);\n")
+		defBuilder.WriteString(fmt.Sprintf(
+			`
+			// Whether the text from start up to the current position spells
+			// out a keyword exactly.
+			bool Token::is_keyword(std::istream &reader, std::streampos start) {
+				static Token (*keywords[])(std::istream &) = { %snullptr };
+				reader.clear();
+				auto end = reader.tellg();
+				bool found = false;
+				for (auto keyword = keywords; *keyword && !found; ++keyword) {
+					reader.seekg(start, std::ios::beg);
+					found = (*keyword)(reader) && reader.tellg() == end;
+					reader.clear();
+				}
+				reader.seekg(end, std::ios::beg);
+				return found;
+			}
+			`,
+			keywords.String(),
+		))
+	}
 
+	layout, newlines, indents := d.layout()
 	protoBuilder.WriteString("static void skip(std::istream &reader);\n")
-	defBuilder.WriteString("void Token::skip(std::istream &reader) {\n")
-	for _, token := range d.SkipTokens {
-		defBuilder.WriteString(TokenCall(token, "reader"))
-		defBuilder.WriteString(";\n")
+	if layout {
+		protoBuilder.WriteString("static void skip_tokens(std::istream &reader);\n")
+	}
+	defBuilder.WriteString(d.skipDefinition())
+
+	var modes strings.Builder
+	for _, mode := range d.Modes {
+		modes.WriteString(mode)
+		modes.WriteString(",\n")
 	}
-	defBuilder.WriteString("}\n")
 
 	b, err := os.ReadFile("src/Token.hpp")
 	if err != nil {
@@ -66,6 +150,12 @@ func (d *ChiselData) writeTokens(file *os.File) error {
 		"TokenTypes":       fmt.Sprintf("*/%s/*", typesBuilder.String()),
 		"TokenPrototypes":  fmt.Sprintf("*/%s/*", protoBuilder.String()),
 		"TokenDefinitions": fmt.Sprintf("*/%s/*", defBuilder.String()),
+		"Modes":            len(d.Modes) > 0,
+		"ModeNames":        fmt.Sprintf("*/%s/*", modes.String()),
+		"Externals":        d.externals(),
+		"Layout":           layout,
+		"LayoutNewlines":   fmt.Sprintf("*/%t/*", newlines),
+		"LayoutIndents":    fmt.Sprintf("*/%t/*", indents),
 	})
 	return nil
 }
@@ -78,15 +168,6 @@ func (d *ChiselData) writeLexer(file *os.File) error {
 	var lexBuilder strings.Builder
 	lexBuilder.WriteString("Token token;\n")
 	for _, token := range d.Tokens {
-		switch token.(type) {
-		case *SimpleToken:
-			continue
-		case SimpleToken:
-			continue
-		default:
-			break
-		}
-
 		lexBuilder.WriteString("token = ")
 		lexBuilder.WriteString(TokenCall(token, "*this->reader"))
 		lexBuilder.WriteString(";\n")
@@ -111,31 +192,157 @@ func (d *ChiselData) writeParser(file *os.File) error {
 	var protoBuilder strings.Builder
 	var rDefBuilder strings.Builder
 	var defBuilder strings.Builder
+	var viewBuilder strings.Builder
+	skips := map[string]bool{}
 	for _, c := range d.Constructs {
-		typesBuilder.WriteString(c.Name)
-		typesBuilder.WriteString(",\n")
+		skipProto, skipDef := c.SkipToCppFunction(skips)
+		rProtoBuilder.WriteString(skipProto)
+		rDefBuilder.WriteString(skipDef)
+
+		// A lexical construct's type is a token type
+		if !c.Lexical {
+			typesBuilder.WriteString(c.Name)
+			typesBuilder.WriteString(",\n")
+		}
 
 		protoBuilder.WriteString(c.ConstructToCppPrototype())
 		protoBuilder.WriteByte('\n')
 
 		rDefBuilder.WriteString(c.Value.RegexToCppFunction())
 		rProtoBuilder.WriteString(c.Value.RegexToCppPrototype())
+		if c.Tail != nil {
+			rDefBuilder.WriteString(c.Tail.RegexToCppFunction())
+			rProtoBuilder.WriteString(c.Tail.RegexToCppPrototype())
+		}
 
 		defBuilder.WriteString(c.ConstructToCppFunction())
 		defBuilder.WriteByte('\n')
+
+		rProtoBuilder.WriteString(c.ActionToCppPrototype())
+		rDefBuilder.WriteString(c.ActionToCppFunction())
+
+		viewBuilder.WriteString(c.ConstructToCppView())
+	}
+	if len(d.Recoveries) > 0 {
+		typesBuilder.WriteString("ERROR,\n")
+	}
+
+	visitor := map[string]string{}
+	if options.Visitor {
+		visitor = d.visitorMethods()
 	}
 
 	b, err := os.ReadFile("src/Parser.hpp")
 	if err != nil {
 		return err
 	}
+	layout, _, _ := d.layout()
 	templ := template.Must(template.New("t").Parse(string(b)))
-	templ.Execute(file, map[string]any{
+	values := map[string]any{
 		"RegexPrototypes":      fmt.Sprintf("*/%s/*", rProtoBuilder.String()),
 		"RegexDefinitions":     fmt.Sprintf("*/%s/*", rDefBuilder.String()),
 		"ConstructTypes":       fmt.Sprintf("*/%s/*", typesBuilder.String()),
 		"ConstructPrototypes":  fmt.Sprintf("*/%s/*", protoBuilder.String()),
 		"ConstructDefinitions": fmt.Sprintf("*/%s/*", defBuilder.String()),
+		"ConstructViews":       fmt.Sprintf("*/%s/*", viewBuilder.String()),
+		"Limits":               options.Limits,
+		"Modes":                len(d.Modes) > 0,
+		"Externals":            d.externals(),
+		"Layout":               layout,
+		"Visitor":              options.Visitor,
+	}
+	for k, v := range visitor {
+		values[k] = fmt.Sprintf("*/%s/*", v)
+	}
+	templ.Execute(file, values)
+	return nil
+}
+
+// visitorMethods fills the Visitor, Listener and Walker of Parser.hpp with
+// a method per construct and per token appearing in trees.
+func (d *ChiselData) visitorMethods() map[string]string {
+	names := []string{}
+	for _, c := range d.Constructs {
+		if !c.Lexical {
+			names = append(names, c.Name)
+		}
+	}
+	if len(d.Recoveries) > 0 {
+		names = append(names, "ERROR")
+	}
+
+	var constructCases, methods, listener, enter, exit strings.Builder
+	for _, name := range names {
+		constructCases.WriteString(fmt.Sprintf(
+			"case Parser::ParseNode::Type::%s: return visit_%s(*node.get_node());\n",
+			name, name,
+		))
+		methods.WriteString(fmt.Sprintf(
+			"virtual R visit_%s(const Parser::ParseNode &node) { return visit_children(node); }\n",
+			name,
+		))
+		listener.WriteString(fmt.Sprintf(
+			"virtual void enter_%s(const Parser::ParseNode &) {}\nvirtual void exit_%s(const Parser::ParseNode &) {}\n",
+			name, name,
+		))
+		enter.WriteString(fmt.Sprintf("case Parser::ParseNode::Type::%s: listener.enter_%s(n); break;\n", name, name))
+		exit.WriteString(fmt.Sprintf("case Parser::ParseNode::Type::%s: listener.exit_%s(n); break;\n", name, name))
+	}
+
+	tokens := []string{}
+	for _, token := range d.Tokens {
+		tokens = append(tokens, TokenName(token))
+	}
+	var tokenCases, walkerTokens strings.Builder
+	for _, name := range append(tokens, d.lexicalNames()...) {
+		tokenCases.WriteString(fmt.Sprintf(
+			"case Token::Type::%s: return visit_%s(node.get_token());\n",
+			name, name,
+		))
+		methods.WriteString(fmt.Sprintf("virtual R visit_%s(const Token &) { return R(); }\n", name))
+		listener.WriteString(fmt.Sprintf("virtual void visit_%s(const Token &) {}\n", name))
+		walkerTokens.WriteString(fmt.Sprintf(
+			"case Token::Type::%s: listener.visit_%s(node.get_token()); break;\n",
+			name, name,
+		))
+	}
+
+	return map[string]string{
+		"VisitorTokenCases":     tokenCases.String(),
+		"VisitorConstructCases": constructCases.String(),
+		"VisitorMethods":        methods.String(),
+		"ListenerMethods":       listener.String(),
+		"WalkerTokenCases":      walkerTokens.String(),
+		"WalkerEnterCases":      enter.String(),
+		"WalkerExitCases":       exit.String(),
+	}
+}
+
+func (d *ChiselData) writeAst(file *os.File) error {
+	var declBuilder strings.Builder
+	var classBuilder strings.Builder
+	var defBuilder strings.Builder
+	for i := range d.Constructs {
+		c := &d.Constructs[i]
+		if c.Lexical {
+			continue
+		}
+		declBuilder.WriteString(fmt.Sprintf("struct %s;\n", c.Name))
+
+		class, definitions := c.ConstructToCppAst()
+		classBuilder.WriteString(class)
+		defBuilder.WriteString(definitions)
+	}
+
+	b, err := os.ReadFile("src/Ast.hpp")
+	if err != nil {
+		return err
+	}
+	templ := template.Must(template.New("t").Parse(string(b)))
+	templ.Execute(file, map[string]any{
+		"AstDeclarations": fmt.Sprintf("*/%s/*", declBuilder.String()),
+		"AstClasses":      fmt.Sprintf("*/%s/*", classBuilder.String()),
+		"AstDefinitions":  fmt.Sprintf("*/%s/*", defBuilder.String()),
 	})
 	return nil
 }
@@ -167,6 +374,12 @@ func (d *ChiselData) WriteFile(filePath string) error {
 		return err
 	}
 
+	if options.AST {
+		if err := d.writeAst(file); err != nil {
+			return err
+		}
+	}
+
 	var epilog strings.Builder
 	for _, suffix := range d.Suffixes {
 		epilog.WriteString(suffix)
@@ -176,28 +389,133 @@ func (d *ChiselData) WriteFile(filePath string) error {
 }
 
 func (d *ChiselData) PopulateConstructs() error {
-	for _, c := range d.SimpleConstructs {
+	// Template uses add constructs as they are met, so they are populated
+	// in turn
+	for i := 0; i < len(d.SimpleConstructs); i++ {
+		c := d.SimpleConstructs[i]
 		r, err := CreateConstructValue(d, c.Value)
 		if err != nil {
 			return err
 		}
 
-		d.Constructs = append(d.Constructs, Construct{
-			Name:  c.Name,
-			Value: r,
-		})
+		construct := Construct{
+			Name:    c.Name,
+			Value:   r,
+			Inline:  c.Inline,
+			Action:  c.Action,
+			Type:    c.Type,
+			NoSkip:  c.NoSkip,
+			Lexical: c.Lexical,
+		}
+		if c.NoSkip && len(c.Skip) > 0 {
+			return fmt.Errorf("%s: @noskip and @skip cannot both be given", c.Name)
+		}
+		if c.Lexical && (len(c.Skip) > 0 || c.Inline || c.Type != "" || c.Action != "") {
+			return fmt.Errorf("%s: @lexical constructs add a token, so take no @skip, @inline, value type or action", c.Name)
+		}
+		for _, name := range c.Skip {
+			token := d.findSkippable(name)
+			if token == nil {
+				return fmt.Errorf("@skip %s: failed to find token of name: '%s'", c.Name, name)
+			}
+			construct.Skip = append(construct.Skip, token)
+		}
+		if c.Type != "" && c.Inline {
+			return fmt.Errorf("%s: inline constructs have no node to hold a value", c.Name)
+		}
+		if c.Type == "" && strings.Contains(c.Action, "$$") {
+			return fmt.Errorf("%s: the action uses $$ but the construct has no value type", c.Name)
+		}
+		if sync, ok := d.Recoveries[c.Name]; ok {
+			if construct.Recover = d.findToken(sync); construct.Recover == nil {
+				return fmt.Errorf("recover %s: failed to find token of name: '%s'", c.Name, sync)
+			}
+		}
+		for _, p := range d.Precedences {
+			if p.Construct != c.Name {
+				continue
+			}
+			if construct.Recover != nil {
+				return fmt.Errorf("precedence %s: constructs with operators cannot recover", c.Name)
+			}
+			if construct.Inline {
+				return fmt.Errorf("precedence %s: constructs with operators cannot be inline", c.Name)
+			}
+			if construct.Action != "" {
+				return fmt.Errorf("precedence %s: constructs with operators cannot have an action", c.Name)
+			}
+			if construct.Precedence, err = CreatePrecedenceTable(d, p.Value); err != nil {
+				return fmt.Errorf("precedence %s: %v", c.Name, err)
+			}
+		}
+		d.Constructs = append(d.Constructs, construct)
+	}
+
+	for _, p := range d.Precedences {
+		if !d.hasSimpleConstruct(p.Construct) {
+			return fmt.Errorf("precedence: failed to find construct of name: '%s'", p.Construct)
+		}
+	}
+
+	for name := range d.Recoveries {
+		if !d.hasSimpleConstruct(name) {
+			return fmt.Errorf("recover: failed to find construct of name: '%s'", name)
+		}
+	}
+	return nil
+}
+
+func (d *ChiselData) findToken(name string) Token {
+	for _, token := range d.Tokens {
+		if TokenName(token) == name {
+			return token
+		}
 	}
 	return nil
 }
 
+// findSkippable finds a skip token, or a token, of the given name.
+func (d *ChiselData) findSkippable(name string) Token {
+	for _, token := range d.SkipTokens {
+		if TokenName(token) == name {
+			return token
+		}
+	}
+	return d.findToken(name)
+}
+
+func (d *ChiselData) hasSimpleConstruct(name string) bool {
+	for _, c := range d.SimpleConstructs {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *ChiselData) AddSimpleConstruct(c SimpleConstruct) {
 	d.SimpleConstructs = append(d.SimpleConstructs, c)
 }
 
+func (d *ChiselData) AddTemplate(c SimpleConstruct) {
+	d.Templates = append(d.Templates, c)
+}
+
 func (d *ChiselData) AddSimpleConstructs(c []SimpleConstruct) {
 	d.SimpleConstructs = append(d.SimpleConstructs, c...)
 }
 
+func (d *ChiselData) AddRecovery(construct, sync string) {
+	if d.Recoveries == nil {
+		d.Recoveries = map[string]string{}
+	}
+	d.Recoveries[construct] = sync
+}
+
+func (d *ChiselData) AddPrecedence(p SimplePrecedence) {
+	d.Precedences = append(d.Precedences, p)
+}
+
 func (d *ChiselData) AddPrefix(s string) {
 	d.Prefixes = append(d.Prefixes, s)
 }
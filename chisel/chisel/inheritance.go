@@ -0,0 +1,202 @@
+package chisel
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Grammar inheritance: `extends "base.chisel";` reads the base grammar
+// first, after which the grammar extending it may redefine its constructs,
+// tokens, precedences and recoveries, add alternatives to its constructs
+// with `NAME |= ...;`, and drop its tokens with `remove NAME;`. Every
+// definition of the base that is replaced is reported.
+
+// extend reads the base grammar at path, relative to the grammar being read.
+func (d *ChiselData) extend(path string, from []string) error {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(d.File), path)
+	}
+	from = append(from, d.File)
+	for _, f := range from {
+		if samePath(f, path) {
+			return fmt.Errorf("extends \"%s\": the grammars extend each other", path)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("extends: %v", err)
+	}
+	defer file.Close()
+
+	current := d.File
+	if err := d.read(file, from); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	d.File = current
+	return nil
+}
+
+func samePath(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
+
+// define records that the grammar being read defines `kind name`, reporting
+// whether that replaces the definition of a grammar it extends.
+func (d *ChiselData) define(kind, name string) bool {
+	if d.Origins == nil {
+		d.Origins = map[string]string{}
+	}
+	key := kind + " " + name
+	origin, ok := d.Origins[key]
+	d.Origins[key] = d.File
+	if !ok || origin == d.File {
+		return false
+	}
+	log.Printf("%s: overrides %s %s of %s\n", d.File, kind, name, origin)
+	return true
+}
+
+// defineConstruct replaces the base's construct or rule template that c
+// redefines where it stands, keeping the order of ParseNode::Type, and
+// reports whether it did. A construct turned into a rule template, or back,
+// is dropped for c to be added.
+func (d *ChiselData) defineConstruct(c SimpleConstruct, template bool) bool {
+	if !d.define("construct", c.Name) {
+		return false
+	}
+	list := &d.SimpleConstructs
+	if template {
+		list = &d.Templates
+	}
+	for i := range *list {
+		if (*list)[i].Name == c.Name {
+			(*list)[i] = c
+			return true
+		}
+	}
+
+	constructs := d.SimpleConstructs[:0]
+	for _, other := range d.SimpleConstructs {
+		if other.Name != c.Name {
+			constructs = append(constructs, other)
+		}
+	}
+	d.SimpleConstructs = constructs
+
+	templates := d.Templates[:0]
+	for _, t := range d.Templates {
+		if t.Name != c.Name {
+			templates = append(templates, t)
+		}
+	}
+	d.Templates = templates
+	return false
+}
+
+// defineTokens replaces the base's tokens that toks redefine where they
+// stand, keeping the order of Token::Type and of lexing, and returns the
+// tokens left to add. A token turned into a skip token, or back, is dropped
+// to be added to the other list.
+func (d *ChiselData) defineTokens(toks []Token, skip bool) []Token {
+	list := &d.Tokens
+	if skip {
+		list = &d.SkipTokens
+	}
+	added := []Token{}
+	for _, tok := range toks {
+		name := TokenName(tok)
+		if !d.define("token", name) {
+			added = append(added, tok)
+			continue
+		}
+		delete(d.TokenModes, name)
+		if i := tokenIndex(*list, name); i >= 0 {
+			(*list)[i] = tok
+			continue
+		}
+		d.removeToken(name)
+		added = append(added, tok)
+	}
+	return added
+}
+
+func tokenIndex(tokens []Token, name string) int {
+	for i, token := range tokens {
+		if TokenName(token) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// definePrecedence drops the base's operators of the construct `name` when
+// the grammar being read declares its own.
+func (d *ChiselData) definePrecedence(name string) {
+	if !d.define("precedence", name) {
+		return
+	}
+	precedences := d.Precedences[:0]
+	for _, p := range d.Precedences {
+		if p.Construct != name {
+			precedences = append(precedences, p)
+		}
+	}
+	d.Precedences = precedences
+}
+
+func (d *ChiselData) removeToken(name string) {
+	tokens := d.Tokens[:0]
+	for _, token := range d.Tokens {
+		if TokenName(token) != name {
+			tokens = append(tokens, token)
+		}
+	}
+	d.Tokens = tokens
+
+	skipTokens := d.SkipTokens[:0]
+	for _, token := range d.SkipTokens {
+		if TokenName(token) != name {
+			skipTokens = append(skipTokens, token)
+		}
+	}
+	d.SkipTokens = skipTokens
+	delete(d.TokenModes, name)
+}
+
+// remove drops a token of a grammar being extended, for `remove NAME;`.
+func (d *ChiselData) remove(name string) error {
+	key := "token " + name
+	origin, ok := d.Origins[key]
+	if !ok || origin == d.File {
+		return fmt.Errorf("remove %s: failed to find a token of that name in the grammars extended", name)
+	}
+	d.removeToken(name)
+	delete(d.Origins, key)
+	log.Printf("%s: removes token %s of %s\n", d.File, name, origin)
+	return nil
+}
+
+// extendConstruct adds the alternatives of `NAME |= value;` to the construct
+// or rule template NAME.
+func (d *ChiselData) extendConstruct(name, value string) error {
+	for _, constructs := range [][]SimpleConstruct{d.SimpleConstructs, d.Templates} {
+		for i := range constructs {
+			c := &constructs[i]
+			if c.Name != name {
+				continue
+			}
+			c.Value = strings.TrimSuffix(strings.TrimSpace(c.Value), ";") + " | " + value
+			if origin := d.Origins["construct "+name]; origin != d.File {
+				log.Printf("%s: adds alternatives to construct %s of %s\n", d.File, name, origin)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s |=: failed to find construct of name: '%s'", name, name)
+}
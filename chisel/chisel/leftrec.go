@@ -0,0 +1,304 @@
+package chisel
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// alternatives splits r on its top level '|'.
+func alternatives(r Regex) []Regex {
+	if v, ok := r.(*OrRegex); ok {
+		return v.Chain
+	}
+	return []Regex{r}
+}
+
+// elements splits r into its top level sequence.
+func elements(r Regex) []Regex {
+	if v, ok := r.(*ChainRegex); ok {
+		return v.Chain
+	}
+	return []Regex{r}
+}
+
+func sequence(rs []Regex) Regex {
+	if len(rs) == 1 {
+		return rs[0]
+	}
+	return &ChainRegex{Chain: rs}
+}
+
+func choice(rs []Regex) Regex {
+	if len(rs) == 1 {
+		return rs[0]
+	}
+	return &OrRegex{Chain: rs}
+}
+
+func leftmostConstruct(r Regex) string {
+	first := elements(r)[0]
+	if v, ok := first.(*LabelRegex); ok {
+		first = v.Inner
+	}
+	if v, ok := first.(*NestedRegex); ok {
+		return v.Construct.Name
+	}
+	return ""
+}
+
+func nullable(r Regex) bool {
+	switch v := r.(type) {
+	case *ChainRegex:
+		for _, re := range v.Chain {
+			if !nullable(re) {
+				return false
+			}
+		}
+		return true
+	case *OrRegex:
+		for _, re := range v.Chain {
+			if nullable(re) {
+				return true
+			}
+		}
+		return false
+	case *CapturedRegex:
+		return nullable(v.Inner)
+	case *MultiplierRegex:
+		return !v.RequireOne || nullable(v.Inner)
+	case *OptionalRegex:
+		return true
+	case *LabelRegex:
+		return nullable(v.Inner)
+	case *BoundedRegex:
+		return v.Min == 0 || nullable(v.Inner)
+	case *SeparatedRegex:
+		return nullable(v.Item)
+	case *LookaheadRegex:
+		return true
+	default:
+		return false
+	}
+}
+
+// leftCorners collects every construct a match of r can start with.
+func leftCorners(r Regex, corners map[string]bool) {
+	switch v := r.(type) {
+	case *NestedRegex:
+		corners[v.Construct.Name] = true
+	case *ChainRegex:
+		for _, re := range v.Chain {
+			leftCorners(re, corners)
+			if !nullable(re) {
+				break
+			}
+		}
+	case *OrRegex:
+		for _, re := range v.Chain {
+			leftCorners(re, corners)
+		}
+	case *CapturedRegex:
+		leftCorners(v.Inner, corners)
+	case *MultiplierRegex:
+		leftCorners(v.Inner, corners)
+	case *OptionalRegex:
+		leftCorners(v.Inner, corners)
+	case *LabelRegex:
+		leftCorners(v.Inner, corners)
+	case *BoundedRegex:
+		leftCorners(v.Inner, corners)
+	case *SeparatedRegex:
+		leftCorners(v.Item, corners)
+		if nullable(v.Item) {
+			leftCorners(v.Separator, corners)
+		}
+	case *LookaheadRegex:
+		leftCorners(v.Inner, corners)
+	}
+}
+
+func (d *ChiselData) findConstruct(name string) *Construct {
+	for i := range d.Constructs {
+		if d.Constructs[i].Name == name {
+			return &d.Constructs[i]
+		}
+	}
+	return nil
+}
+
+// leftReaches reports whether a match of the construct `from` can start with
+// a match of the construct `to`.
+func (d *ChiselData) leftReaches(from, to string) bool {
+	seen := map[string]bool{}
+	stack := []string{from}
+	for len(stack) > 0 {
+		c := d.findConstruct(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+		if c == nil {
+			continue
+		}
+
+		corners := map[string]bool{}
+		leftCorners(c.Value, corners)
+		for corner := range corners {
+			if corner == to {
+				return true
+			}
+			if !seen[corner] {
+				seen[corner] = true
+				stack = append(stack, corner)
+			}
+		}
+	}
+	return false
+}
+
+// inlineLeftCorners substitutes the alternatives of any construct leading alt
+// that leads back to `name`, turning indirect left recursion into direct.
+func (d *ChiselData) inlineLeftCorners(name string, alt Regex, inlined map[string]bool) ([]Regex, error) {
+	first := leftmostConstruct(alt)
+	if first == "" || first == name || !d.leftReaches(first, name) {
+		return []Regex{alt}, nil
+	}
+	if inlined[first] {
+		return nil, fmt.Errorf("left recursion in %s through %s could not be eliminated", name, first)
+	}
+
+	other := d.findConstruct(first)
+	if other == nil || other.Precedence != nil || other.Tail != nil {
+		return nil, fmt.Errorf("left recursion in %s through %s could not be eliminated", name, first)
+	}
+
+	path := map[string]bool{first: true}
+	for k := range inlined {
+		path[k] = true
+	}
+
+	rest := elements(alt)[1:]
+	result := []Regex{}
+	for _, b := range alternatives(other.Value) {
+		seq := append(append([]Regex{}, elements(b)...), rest...)
+		expanded, err := d.inlineLeftCorners(name, sequence(seq), path)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded...)
+	}
+	return result, nil
+}
+
+// EliminateLeftRecursion rewrites `A = A x | y;` (directly or through other
+// constructs) into `A = y (x)*;`, keeping the tree left associative through
+// Construct.Tail.
+func (d *ChiselData) EliminateLeftRecursion() error {
+	for i := range d.Constructs {
+		c := &d.Constructs[i]
+		if c.Precedence != nil || !d.leftReaches(c.Name, c.Name) {
+			continue
+		}
+
+		alts := []Regex{}
+		for _, alt := range alternatives(c.Value) {
+			expanded, err := d.inlineLeftCorners(c.Name, alt, map[string]bool{})
+			if err != nil {
+				return err
+			}
+			alts = append(alts, expanded...)
+		}
+
+		bases := []Regex{}
+		tails := []Regex{}
+		for _, alt := range alts {
+			if leftmostConstruct(alt) != c.Name {
+				bases = append(bases, alt)
+				continue
+			}
+
+			els := elements(alt)
+			if len(els) == 1 {
+				return fmt.Errorf("construct %s matches only itself", c.Name)
+			}
+			tail := sequence(els[1:])
+			if v, ok := alt.(*ChainRegex); ok && v.Cut > 1 {
+				tail.(*ChainRegex).Cut = v.Cut - 1
+			}
+			tails = append(tails, tail)
+
+			label := ""
+			if v, ok := els[0].(*LabelRegex); ok {
+				label = v.Label
+			}
+			if len(tails) > 1 && label != c.TailLabel {
+				return fmt.Errorf("left recursive alternatives of %s label %s differently", c.Name, c.Name)
+			}
+			c.TailLabel = label
+		}
+		if len(tails) == 0 {
+			continue
+		}
+		if len(bases) == 0 {
+			return fmt.Errorf("left recursive construct %s has no alternative to start from", c.Name)
+		}
+
+		before := RegexSource(c.Value)
+		c.Value = choice(bases)
+		c.Tail = choice(tails)
+		log.Printf(
+			"warning: rewrote left recursive construct `%s = %s;` as `%s = %s (%s)*;`\n",
+			c.Name, before,
+			c.Name, RegexSource(&ChainRegex{Chain: []Regex{c.Value}}), RegexSource(c.Tail),
+		)
+	}
+
+	for _, c := range d.Constructs {
+		if c.Precedence == nil && d.leftReaches(c.Name, c.Name) {
+			return fmt.Errorf("left recursion in %s could not be eliminated", c.Name)
+		}
+	}
+	return nil
+}
+
+func (c *Construct) leftFoldBody() string {
+	label := ""
+	if c.TailLabel != "" {
+		label = fmt.Sprintf("parent->get_children().back().set_label(%s);", strconv.Quote(c.TailLabel))
+	}
+	action := ""
+	if c.Action != "" {
+		action = fmt.Sprintf("Parser::action_%s(*tree);", c.Name)
+	}
+	return fmt.Sprintf(
+		`
+		auto tree = new ParseNode(ParseNode::Type::%s);
+		bool success = %s;
+		if (success) {
+			%s
+		}
+		while (success) {
+			auto before = Parser::mark(reader);
+			std::vector<Node> tail;
+			if (!%s || Parser::mark(reader) == before) {
+				Parser::restore(reader, before);
+				success = !Parser::cut;
+				break;
+			}
+			auto parent = new ParseNode(ParseNode::Type::%s);
+			parent->get_children().emplace_back(tree);
+			%s
+			for (auto &child : tail)
+				parent->get_children().emplace_back(child);
+			tree = parent;
+			%s
+		}
+		Node node(tree);
+		`,
+		c.Name,
+		RegexCall(c.Value, "reader", "tree->get_children()"),
+		action,
+		RegexCall(c.Tail, "reader", "tail"),
+		c.Name,
+		label,
+		action,
+	)
+}
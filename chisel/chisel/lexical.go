@@ -0,0 +1,213 @@
+package chisel
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// Scannerless rules: a construct marked @lexical matches character by
+// character, skipping nothing between its parts, and adds a single token of
+// its own name holding the text it matched. Character classes such as
+// `[0-9]` or `[^"\\]` match one character, and are declared as anonymous
+// tokens the way inline literals are.
+
+type charRange struct {
+	From, To rune
+}
+
+// readCharClass reads a `[...]` character class, returning its source, the
+// ranges it lists and whether it is negated with a leading '^'.
+func readCharClass(r *bufio.Reader) (string, []charRange, bool, error) {
+	if c, _, err := r.ReadRune(); err != nil || c != '[' {
+		return "", nil, false, fmt.Errorf("expected '[' opening a character class")
+	}
+
+	var source strings.Builder
+	source.WriteByte('[')
+	negated := false
+	if b, err := r.Peek(1); err == nil && b[0] == '^' {
+		r.Discard(1)
+		source.WriteByte('^')
+		negated = true
+	}
+
+	// next reads a character of the class, reporting whether it closed it
+	next := func() (rune, bool, error) {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return 0, false, fmt.Errorf("character class: expected closing ']'")
+		}
+		source.WriteRune(c)
+		if c == ']' {
+			return 0, true, nil
+		}
+		if c != '\\' {
+			return c, false, nil
+		}
+
+		c, _, err = r.ReadRune()
+		if err != nil {
+			return 0, false, fmt.Errorf("character class: expected closing ']'")
+		}
+		source.WriteRune(c)
+		switch c {
+		case 'n':
+			return '\n', false, nil
+		case 't':
+			return '\t', false, nil
+		case 'r':
+			return '\r', false, nil
+		case '0':
+			return 0, false, nil
+		default:
+			return c, false, nil
+		}
+	}
+
+	ranges := []charRange{}
+	for {
+		from, closed, err := next()
+		if err != nil {
+			return "", nil, false, err
+		}
+		if closed {
+			break
+		}
+
+		to := from
+		if b, err := r.Peek(1); err == nil && b[0] == '-' {
+			if b, err := r.Peek(2); err == nil && b[1] != ']' {
+				r.Discard(1)
+				source.WriteByte('-')
+				if to, closed, err = next(); err != nil {
+					return "", nil, false, err
+				}
+				if closed {
+					return "", nil, false, fmt.Errorf("character class: range %c- has no end", from)
+				}
+				if to < from {
+					return "", nil, false, fmt.Errorf("character class: range %c-%c is backwards", from, to)
+				}
+			}
+		}
+		ranges = append(ranges, charRange{From: from, To: to})
+	}
+	if len(ranges) == 0 {
+		return "", nil, false, fmt.Errorf("empty character class")
+	}
+	return source.String(), ranges, negated, nil
+}
+
+// charClassCode matches one UTF-8 character in, or with negated not in, the
+// ranges.
+func charClassCode(name string, ranges []charRange, negated bool) string {
+	tests := []string{}
+	for _, cr := range ranges {
+		if cr.From == cr.To {
+			tests = append(tests, fmt.Sprintf("c == 0x%x", cr.From))
+		} else {
+			tests = append(tests, fmt.Sprintf("(c >= 0x%x && c <= 0x%x)", cr.From, cr.To))
+		}
+	}
+	test := strings.Join(tests, " || ")
+	if negated {
+		test = "!(" + test + ")"
+	}
+
+	return fmt.Sprintf(
+		`(std::istream &reader) {
+			reader.clear();
+			auto start = reader.tellg();
+			char32_t c;
+			if (!Token::read_utf8(reader, c) || !(%s)) {
+				reader.clear();
+				reader.seekg(start, std::ios::beg);
+				return Token::failed;
+			}
+			std::string buf(size_t(reader.tellg() - start), '\0');
+			reader.seekg(start, std::ios::beg);
+			reader.read(&buf[0], buf.size());
+			return Token::make(Token::Type::%s, buf);
+		}`,
+		test,
+		name,
+	)
+}
+
+// CharClass reads a character class and returns the token matching it,
+// declaring an anonymous FunctionToken the first time the class is used.
+func (d *ChiselData) CharClass(r *bufio.Reader) (Token, error) {
+	source, ranges, negated, err := readCharClass(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range d.Tokens {
+		if v, ok := token.(FunctionToken); ok && v.Class == source {
+			return v, nil
+		}
+	}
+
+	name := "CLASS_1"
+	for i := 2; d.findToken(name) != nil || d.hasSimpleConstruct(name); i++ {
+		name = fmt.Sprintf("CLASS_%d", i)
+	}
+	token := FunctionToken{
+		Name:  name,
+		Code:  charClassCode(name, ranges, negated),
+		Class: source,
+	}
+	d.AddToken(token)
+	return token, nil
+}
+
+// lexicalBody matches a @lexical construct into `node`, a token holding the
+// text matched. Failing, it is expected as a whole rather than by the
+// characters it stopped at.
+func (c *Construct) lexicalBody() string {
+	tail := ""
+	if c.Tail != nil {
+		tail = fmt.Sprintf(
+			`
+			while (success) {
+				auto before = Parser::mark(reader);
+				if (!%s || Parser::mark(reader) == before) {
+					Parser::restore(reader, before);
+					success = !Parser::cut;
+					break;
+				}
+			}
+			`,
+			RegexCall(c.Tail, "reader", "children"),
+		)
+	}
+	return fmt.Sprintf(
+		`
+		auto from = Parser::mark(reader);
+		auto saved = Parser::error;
+		std::vector<Node> children;
+		bool success = %s;
+		%s
+		if (!success) {
+			Parser::error = saved;
+			Parser::expect(reader, from, %q);
+		}
+		Node node(Token::make(Token::Type::%s, success ? Parser::text(reader, from, Parser::mark(reader)) : std::string()));
+		`,
+		RegexCall(c.Value, "reader", "children"),
+		tail,
+		c.Name,
+		c.Name,
+	)
+}
+
+// lexicalNames lists the @lexical constructs, whose names are token types.
+func (d *ChiselData) lexicalNames() []string {
+	names := []string{}
+	for _, c := range d.Constructs {
+		if c.Lexical {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
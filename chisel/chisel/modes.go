@@ -0,0 +1,203 @@
+package chisel
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// Lexer modes: tokens declared in `mode NAME { ... }` only match while NAME
+// is the current mode, and tokens declared with @push(NAME) or @pop change
+// it. Once a grammar declares a mode, the tokens declared outside of any
+// belong to DEFAULT, the mode a parse starts in. Inline literals match in
+// every mode.
+
+const defaultMode = "DEFAULT"
+
+// readMode reads the declarations of `mode NAME { tok ...; skip ...; }`, the
+// name having been read.
+func (d *ChiselData) readMode(r *bufio.Reader, name string) error {
+	if syntaxTokenType([]byte(name)) != ID {
+		return fmt.Errorf("mode: expected a mode name, got '%s'", name)
+	}
+	if name == defaultMode {
+		return fmt.Errorf("mode %s: the tokens of the default mode are declared outside of any mode", name)
+	}
+	next := syntaxReader(r)
+	if open, err := next(); err != nil || open != "{" {
+		return fmt.Errorf("mode %s: expected '{'", name)
+	}
+
+	found := false
+	for _, mode := range d.Modes {
+		found = found || mode == name
+	}
+	if !found {
+		d.Modes = append(d.Modes, name)
+	}
+	if d.TokenModes == nil {
+		d.TokenModes = map[string]string{}
+	}
+
+	for {
+		token, err := next()
+		if err != nil {
+			return fmt.Errorf("mode %s: expected '}'", name)
+		}
+
+		var toks []Token
+		switch token {
+		case ";", ")":
+			// The ')' closing a token list is left behind, as at the top level
+			continue
+		case "}":
+			return nil
+		case "tok":
+			if toks, err = CreateTokens(r); err != nil {
+				return err
+			}
+			d.AddTokens(d.defineTokens(toks, false))
+		case "skip":
+			if toks, err = CreateSkipTokens(r); err != nil {
+				return err
+			}
+			d.AddSkipTokens(d.defineTokens(toks, true))
+		default:
+			return fmt.Errorf("mode %s: expected 'tok', 'skip' or '}', got '%s'", name, token)
+		}
+		for _, tok := range toks {
+			d.TokenModes[TokenName(tok)] = name
+		}
+	}
+}
+
+// CheckModes makes sure every mode a token pushes is declared.
+func (d *ChiselData) CheckModes() error {
+	for _, token := range d.Tokens {
+		push, pop := tokenTransition(token)
+		if (push != "" || pop) && len(d.Modes) == 0 {
+			return fmt.Errorf("token %s changes the lexer mode, but no modes are declared", TokenName(token))
+		}
+		if push == "" || push == defaultMode {
+			continue
+		}
+
+		found := false
+		for _, mode := range d.Modes {
+			found = found || mode == push
+		}
+		if !found {
+			return fmt.Errorf("@push: token %s: failed to find mode of name: '%s'", TokenName(token), push)
+		}
+	}
+	return nil
+}
+
+func tokenTransition(t Token) (string, bool) {
+	switch v := t.(type) {
+	case LiteralToken:
+		return v.Push, v.Pop
+	case FunctionToken:
+		return v.Push, v.Pop
+	default:
+		return "", false
+	}
+}
+
+// tokenMode is the mode t matches in, or empty when it matches in any.
+func (d *ChiselData) tokenMode(t Token) string {
+	if len(d.Modes) == 0 {
+		return ""
+	}
+	if mode, ok := d.TokenModes[TokenName(t)]; ok {
+		return mode
+	}
+	if v, ok := t.(LiteralToken); ok && v.Inline {
+		return ""
+	}
+	return defaultMode
+}
+
+// wrapped reports whether t is matched by lex_NAME, wrapped in a token_NAME
+// checking and changing the mode, or making way for the layout tokens.
+func (d *ChiselData) wrapped(t Token) bool {
+	push, pop := tokenTransition(t)
+	return d.tokenMode(t) != "" || push != "" || pop || d.yieldsToLayout(t)
+}
+
+func (d *ChiselData) yieldsToLayout(t Token) bool {
+	if layout, _, _ := d.layout(); !layout {
+		return false
+	}
+	v, ok := t.(FunctionToken)
+	return !ok || v.Layout == ""
+}
+
+func (d *ChiselData) tokenWrapper(t Token) string {
+	check := ""
+	if mode := d.tokenMode(t); mode != "" {
+		check = fmt.Sprintf("if (Token::mode() != Token::Mode::%s) return Token::failed;", mode)
+	}
+	if d.yieldsToLayout(t) {
+		check += "\nif (Token::layout_pending(reader)) return Token::failed;"
+	}
+	change := ""
+	push, pop := tokenTransition(t)
+	if pop {
+		change += "Token::pop_mode(reader);\n"
+	}
+	if push != "" {
+		change += fmt.Sprintf("Token::push_mode(reader, Token::Mode::%s);\n", push)
+	}
+	if change != "" {
+		change = "if (token) {\n" + change + "}"
+	}
+
+	return fmt.Sprintf(
+		`
+		Token Token::token_%s(std::istream &reader) {
+			%s
+			auto token = Token::lex_%s(reader);
+			%s
+			return token;
+		}
+		`,
+		TokenName(t),
+		check,
+		TokenName(t),
+		change,
+	)
+}
+
+// skipDefinition defines Token::skip, skipping the skip tokens of the current
+// mode. With a layout that is Token::skip_tokens, which Token::skip wraps.
+func (d *ChiselData) skipDefinition() string {
+	var b strings.Builder
+	if layout, _, _ := d.layout(); layout {
+		b.WriteString("void Token::skip_tokens(std::istream &reader) {\n")
+	} else {
+		b.WriteString("void Token::skip(std::istream &reader) {\n")
+	}
+	if len(d.Modes) == 0 {
+		for _, token := range d.SkipTokens {
+			b.WriteString(TokenCall(token, "reader"))
+			b.WriteString(";\n")
+		}
+		b.WriteString("}\n")
+		return b.String()
+	}
+
+	b.WriteString("switch (Token::mode()) {\n")
+	for _, mode := range append([]string{defaultMode}, d.Modes...) {
+		b.WriteString(fmt.Sprintf("case Token::Mode::%s:\n", mode))
+		for _, token := range d.SkipTokens {
+			if d.tokenMode(token) == mode {
+				b.WriteString(TokenCall(token, "reader"))
+				b.WriteString(";\n")
+			}
+		}
+		b.WriteString("break;\n")
+	}
+	b.WriteString("}\n}\n")
+	return b.String()
+}
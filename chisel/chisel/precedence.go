@@ -0,0 +1,142 @@
+package chisel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Operator struct {
+	Token      Token
+	Precedence int
+	Right      bool
+}
+
+// PrecedenceTable turns a construct into a precedence climbing parser whose
+// operands are matched by the construct's own rule.
+type PrecedenceTable struct {
+	Prefix []Operator
+	Infix  []Operator
+}
+
+type SimplePrecedence struct {
+	Construct string
+	Value     string
+}
+
+// CreatePrecedenceTable parses the body of a `precedence NAME { ... }` block:
+//
+//	infix left 10 PLUS MINUS;
+//	infix right 20 POW;
+//	prefix 30 MINUS;
+func CreatePrecedenceTable(data *ChiselData, value string) (*PrecedenceTable, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "{"), "}")
+
+	table := &PrecedenceTable{}
+	for _, decl := range strings.Split(value, ";") {
+		fields := strings.Fields(decl)
+		if len(fields) == 0 {
+			continue
+		}
+
+		kind := fields[0]
+		fields = fields[1:]
+		right := false
+		switch kind {
+		case "infix":
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("infix: expected 'left' or 'right'")
+			}
+			switch fields[0] {
+			case "left":
+			case "right":
+				right = true
+			default:
+				return nil, fmt.Errorf("infix: expected 'left' or 'right', got '%s'", fields[0])
+			}
+			fields = fields[1:]
+		case "prefix":
+		default:
+			return nil, fmt.Errorf("expected 'infix' or 'prefix', got '%s'", kind)
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s: expected a precedence followed by tokens", kind)
+		}
+		precedence, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad precedence '%s'", kind, fields[0])
+		}
+
+		for _, name := range fields[1:] {
+			token := data.findToken(name)
+			if token == nil {
+				return nil, fmt.Errorf("%s: failed to find token of name: '%s'", kind, name)
+			}
+
+			op := Operator{
+				Token:      token,
+				Precedence: precedence,
+				Right:      right,
+			}
+			if kind == "prefix" {
+				table.Prefix = append(table.Prefix, op)
+			} else {
+				table.Infix = append(table.Infix, op)
+			}
+		}
+	}
+	return table, nil
+}
+
+func operatorsToCpp(ops []Operator) string {
+	var b strings.Builder
+	for _, op := range ops {
+		b.WriteString(fmt.Sprintf(
+			"{ &%s, %s, %d, %v },\n",
+			TokenFunction(op.Token),
+			strconv.Quote(TokenName(op.Token)),
+			op.Precedence,
+			op.Right,
+		))
+	}
+	return b.String()
+}
+
+func (c *Construct) precedenceToCppFunction() string {
+	return fmt.Sprintf(
+		`
+		Parser::Node Parser::construct_%s(std::istream &reader) {
+			static const OperatorTable table = {
+				ParseNode::Type::%s,
+				{
+					%s
+				},
+				{
+					%s
+				},
+				&Parser::%s,
+			};
+
+			Parser::enter(reader);
+			%s
+			std::vector<Node> nodes;
+			bool success = Parser::climb(reader, table, 0, nodes);
+			%s
+			Parser::leave(reader, success);
+			if (!success) {
+				return Node::failed;
+			}
+			return nodes[0];
+		}
+		`,
+		c.Name,
+		c.Name,
+		operatorsToCpp(c.Precedence.Prefix),
+		operatorsToCpp(c.Precedence.Infix),
+		RegexFunction(c.Value),
+		c.skipPrologue(),
+		c.skipEpilogue(),
+	)
+}
@@ -4,12 +4,75 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strings"
+	"unicode"
 )
 
+// Options toggles optional parts of the generated parser.
+type Options struct {
+	// Limits emits a construct depth counter and a parse step counter into
+	// the Parser, bounded at runtime by set_max_depth and set_max_steps.
+	Limits bool
+
+	// AST emits a typed class per construct into `chisel::ast`, built from a
+	// successful parse with NAME::build.
+	AST bool
+
+	// Visitor emits a Visitor<R> base class, a Listener and a Walker with a
+	// method per construct and token.
+	Visitor bool
+}
+
+var options Options
+
 func ReadAndWrite(file *os.File, outputPath string) error {
+	return ReadAndWriteWithOptions(file, outputPath, Options{})
+}
+
+func ReadAndWriteWithOptions(file *os.File, outputPath string, opts Options) error {
+	options = opts
 	data := &ChiselData{}
+	if err := data.read(file, nil); err != nil {
+		return err
+	}
+
+	if err := data.CheckModes(); err != nil {
+		return err
+	}
+
+	if err := data.CheckLayout(); err != nil {
+		return err
+	}
+
+	if err := data.PopulateConstructs(); err != nil {
+		return err
+	}
+
+	if err := data.EliminateLeftRecursion(); err != nil {
+		return err
+	}
+
+	// for _, c := range data.Constructs {
+	// 	fmt.Println(c.String())
+	// }
+
+	if err := data.WriteFile(outputPath); err != nil {
+		return err
+	}
+	return nil
+}
+
+// read reads the declarations of a grammar into d. `from` lists the grammars
+// extending it, the one extending it directly last.
+func (d *ChiselData) read(file *os.File, from []string) error {
+	d.File = file.Name()
 	r := bufio.NewReader(file)
 
+	// Attributes read before the next construct, as in `@inline NAME = ...;`
+	attributes := []string{}
+	// Whether anything was declared yet, which `extends` must come before
+	declared := false
+
 	last := ""
 	next := func() (string, error) {
 		if last != "" {
@@ -23,12 +86,51 @@ func ReadAndWrite(file *os.File, outputPath string) error {
 			continue
 		}
 
+		if token == "extends" {
+			if declared {
+				return fmt.Errorf("extends must come before any declaration")
+			}
+			path, err := stringReader(r)()
+			if err != nil {
+				return fmt.Errorf("extends: %v", err)
+			}
+			if err := d.extend(path, from); err != nil {
+				return err
+			}
+			declared = true
+			continue
+		}
+		declared = true
+
+		if token == "@" {
+			attribute, err := next()
+			if err != nil {
+				return err
+			}
+			// An argument is kept as written, as in `skip(WS, COMMENT)`
+			if err := skipWhitespace(r); err != nil {
+				return err
+			}
+			if b, err := r.Peek(1); err == nil && b[0] == '(' {
+				argument, err := scopeReader('(', ')', r)()
+				if err != nil {
+					return err
+				}
+				attribute += argument
+			}
+			attributes = append(attributes, attribute)
+			continue
+		}
+		if len(attributes) > 0 && syntaxTokenType([]byte(token)) != ID {
+			return fmt.Errorf("attribute '@%s' must come before a construct", attributes[0])
+		}
+
 		if token == "prefix" {
 			next = scopeReader('{', '}', r)
 			if token, err = next(); err != nil {
 				return err
 			}
-			data.AddPrefix(token)
+			d.AddPrefix(token)
 			continue
 		}
 
@@ -37,7 +139,7 @@ func ReadAndWrite(file *os.File, outputPath string) error {
 			if token, err = next(); err != nil {
 				return err
 			}
-			data.AddSuffix(token)
+			d.AddSuffix(token)
 			continue
 		}
 
@@ -46,24 +148,137 @@ func ReadAndWrite(file *os.File, outputPath string) error {
 			if err != nil {
 				return err
 			}
-			data.AddTokens(toks)
+			d.AddTokens(d.defineTokens(toks, false))
 			continue
 		}
 
-		if token == "skip" {
+		if token == "remove" {
+			for {
+				name, err := next()
+				if err != nil {
+					return fmt.Errorf("remove: expected ';'")
+				}
+				if name == ";" {
+					break
+				}
+				if name == "," {
+					continue
+				}
+				if err := d.remove(name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if token == "mode" {
+			name, err := next()
+			if err != nil {
+				return err
+			}
+			if err := d.readMode(r, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if token == "keyword" {
 			toks, err := CreateTokens(r)
 			if err != nil {
 				return err
 			}
-			data.AddSkipTokens(toks)
+			for i, tok := range toks {
+				v, ok := tok.(LiteralToken)
+				if !ok {
+					return fmt.Errorf("keyword %s: expected a string literal", TokenName(tok))
+				}
+				v.Keyword = true
+				toks[i] = v
+			}
+			d.AddTokens(d.defineTokens(toks, false))
+			continue
+		}
+
+		if token == "skip" {
+			toks, err := CreateSkipTokens(r)
+			if err != nil {
+				return err
+			}
+			d.AddSkipTokens(d.defineTokens(toks, true))
+			continue
+		}
+
+		if token == "precedence" {
+			name, err := next()
+			if err != nil {
+				return err
+			}
+			next = scopeReader('{', '}', r)
+			if token, err = next(); err != nil {
+				return err
+			}
+			d.definePrecedence(name)
+			d.AddPrecedence(SimplePrecedence{
+				Construct: name,
+				Value:     token,
+			})
+			continue
+		}
+
+		if token == "recover" {
+			name, err := next()
+			if err != nil {
+				return err
+			}
+			until, err := next()
+			if err != nil {
+				return err
+			}
+			if syntaxTokenType([]byte(until)) != UNTIL {
+				return fmt.Errorf("Expected 'until', got '%s'", until)
+			}
+			sync, err := next()
+			if err != nil {
+				return err
+			}
+			d.define("recovery", name)
+			d.AddRecovery(name, sync)
 			continue
 		}
 
 		if syntaxTokenType([]byte(token)) == ID {
+			params, err := readParameters(r)
+			if err != nil {
+				return err
+			}
+			typ, err := readValueType(r)
+			if err != nil {
+				return err
+			}
+
 			eq, err := next()
 			if err != nil {
 				return err
 			}
+			if eq == "|" {
+				if eq, err = next(); err != nil || syntaxTokenType([]byte(eq)) != EQ {
+					return fmt.Errorf("%s: expected '|=' or '='", token)
+				}
+				if len(params) > 0 || typ != "" || len(attributes) > 0 {
+					return fmt.Errorf("%s |=: only adds alternatives, so takes no parameters, value type or attributes", token)
+				}
+				value, err := constructReader(r)()
+				if err != nil {
+					return err
+				}
+				if b, err := r.Peek(1); err == nil && b[0] == '{' {
+					return fmt.Errorf("%s |=: only adds alternatives, so takes no action", token)
+				}
+				if err := d.extendConstruct(token, value); err != nil {
+					return err
+				}
+				continue
+			}
 			if syntaxTokenType([]byte(eq)) != EQ {
 				return fmt.Errorf("Expected '=', got '%s'", eq)
 			}
@@ -73,23 +288,54 @@ func ReadAndWrite(file *os.File, outputPath string) error {
 			if err != nil {
 				return err
 			}
-			data.AddSimpleConstruct(SimpleConstruct{
-				Name:  token,
-				Value: c,
-			})
-		}
-	}
-
-	if err := data.PopulateConstructs(); err != nil {
-		return err
-	}
-
-	// for _, c := range data.Constructs {
-	// 	fmt.Println(c.String())
-	// }
+			construct := SimpleConstruct{
+				Name:   token,
+				Value:  c,
+				Type:   typ,
+				Inline: strings.HasPrefix(token, "_"),
+				Params: params,
+			}
+			if b, err := r.Peek(1); err == nil && b[0] == '{' {
+				next = scopeReader('{', '}', r)
+				if construct.Action, err = next(); err != nil {
+					return err
+				}
+			}
+			for _, attribute := range attributes {
+				attribute, argument, _ := strings.Cut(attribute, "(")
+				argument = strings.TrimSuffix(argument, ")")
+				if argument != "" && attribute != "skip" {
+					return fmt.Errorf("@%s takes no argument", attribute)
+				}
 
-	if err := data.WriteFile(outputPath); err != nil {
-		return err
+				switch attribute {
+				case "inline":
+					construct.Inline = true
+				case "noskip":
+					construct.NoSkip = true
+				case "lexical":
+					construct.Lexical = true
+				case "skip":
+					construct.Skip = strings.FieldsFunc(argument, func(c rune) bool {
+						return c == ',' || unicode.IsSpace(c)
+					})
+					if len(construct.Skip) == 0 {
+						return fmt.Errorf("@skip: expected the tokens to skip, as in @skip(WS)")
+					}
+				default:
+					return fmt.Errorf("unknown construct attribute: '@%s'", attribute)
+				}
+			}
+			attributes = attributes[:0]
+			if d.defineConstruct(construct, len(params) > 0) {
+				continue
+			}
+			if len(params) > 0 {
+				d.AddTemplate(construct)
+			} else {
+				d.AddSimpleConstruct(construct)
+			}
+		}
 	}
 	return nil
 }
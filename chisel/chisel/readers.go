@@ -15,6 +15,10 @@ const (
 	SUFFIX
 	TOK
 	SKIP
+	KEYWORD
+	RECOVER
+	UNTIL
+	PRECEDENCE
 
 	O_BRACE
 	C_BRACE
@@ -31,12 +35,12 @@ const (
 	SCOPER
 )
 
-func isValidId(c byte) bool {
-	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_'
+func isValidId(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
 }
 
-func isValidIdStarter(c byte) bool {
-	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || c == '_'
+func isValidIdStarter(c rune) bool {
+	return unicode.IsLetter(c) || c == '_'
 }
 
 func syntaxTokenType(token []byte) splitterTokenType {
@@ -64,6 +68,18 @@ func syntaxTokenType(token []byte) splitterTokenType {
 	if eq(token, "skip") {
 		return SKIP
 	}
+	if eq(token, "keyword") {
+		return KEYWORD
+	}
+	if eq(token, "recover") {
+		return RECOVER
+	}
+	if eq(token, "until") {
+		return UNTIL
+	}
+	if eq(token, "precedence") {
+		return PRECEDENCE
+	}
 
 	if eq(token, "{") {
 		return O_BRACE
@@ -122,6 +138,7 @@ func syntaxReader(r *bufio.Reader) func() (string, error) {
 			"suffix",
 			"tok",
 			"skip",
+			"@",
 
 			"{",
 			"}",
@@ -151,23 +168,24 @@ func syntaxReader(r *bufio.Reader) func() (string, error) {
 			}
 		}
 
-		b, err := r.Peek(1)
+		b, _, err := r.ReadRune()
 		if err != nil {
 			return "", err
 		}
-		if isValidIdStarter(b[0]) {
+		r.UnreadRune()
+		if isValidIdStarter(b) {
 			var buffer strings.Builder
-			for c, err := r.ReadByte(); isValidId(c); c, err = r.ReadByte() {
+			for c, _, err := r.ReadRune(); isValidId(c); c, _, err = r.ReadRune() {
 				if err != nil {
 					break
 				}
 
-				err := buffer.WriteByte(c)
+				_, err := buffer.WriteRune(c)
 				if err != nil {
 					return "", err
 				}
 			}
-			r.UnreadByte()
+			r.UnreadRune()
 			return buffer.String(), nil
 		}
 		return "", fmt.Errorf("No syntax tokens found!")
@@ -281,12 +299,27 @@ func constructReader(r *bufio.Reader) func() (string, error) {
 		}
 
 		slash := false
+		var quote byte
 		var buffer strings.Builder
 		for c, err := r.ReadByte(); ; c, err = r.ReadByte() {
 			if err != nil {
 				return "", err
 			}
 
+			// String literals are kept verbatim for stringReader to unquote,
+			// and character classes for readCharClass
+			if quote != 0 {
+				buffer.WriteByte(c)
+				if slash {
+					slash = false
+				} else if c == '\\' {
+					slash = true
+				} else if c == quote {
+					quote = 0
+				}
+				continue
+			}
+
 			if slash {
 				slash = false
 				continue
@@ -299,9 +332,88 @@ func constructReader(r *bufio.Reader) func() (string, error) {
 
 			buffer.WriteByte(c)
 
+			if c == '"' || c == '\'' {
+				quote = c
+				continue
+			}
+			if c == '[' {
+				quote = ']'
+				continue
+			}
+
 			if c == ';' {
 				return buffer.String(), nil
 			}
+
+			// A semantic action follows the rule, unless the brace opens
+			// a repetition count
+			if c == '{' {
+				r.UnreadByte()
+				if repetitionAhead(r) {
+					r.Discard(1)
+					continue
+				}
+				s := buffer.String()
+				return s[:len(s)-1] + ";", nil
+			}
+		}
+	}
+}
+
+// readAttributes reads any number of leading `@name` or `@name(argument)`
+// attributes, keeping the argument in the attribute as written.
+func readAttributes(r *bufio.Reader) ([]string, error) {
+	attributes := []string{}
+	for {
+		if err := skipWhitespace(r); err != nil {
+			return nil, err
+		}
+
+		b, err := r.Peek(1)
+		if err != nil || b[0] != '@' {
+			return attributes, nil
+		}
+		r.Discard(1)
+
+		var buffer strings.Builder
+		for c, _, err := r.ReadRune(); isValidId(c); c, _, err = r.ReadRune() {
+			if err != nil {
+				break
+			}
+			buffer.WriteRune(c)
+		}
+		r.UnreadRune()
+		if buffer.Len() == 0 {
+			return nil, fmt.Errorf("Expected an attribute name after '@'")
+		}
+		if b, err := r.Peek(1); err == nil && b[0] == '(' {
+			argument, err := scopeReader('(', ')', r)()
+			if err != nil {
+				return nil, err
+			}
+			buffer.WriteString(argument)
+		}
+		attributes = append(attributes, buffer.String())
+	}
+}
+
+// repetitionAhead reports whether the '{' about to be read opens a repetition
+// count such as `{2}` or `{1, 3}` rather than a block of code.
+func repetitionAhead(r *bufio.Reader) bool {
+	digits := false
+	for n := 2; ; n++ {
+		b, _ := r.Peek(n)
+		if len(b) < n {
+			return false
+		}
+		switch c := b[n-1]; {
+		case c == '}':
+			return digits
+		case c >= '0' && c <= '9':
+			digits = true
+		case c == ',' || c == ' ' || c == '\t':
+		default:
+			return false
 		}
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strconv"
 	"strings"
 )
 
@@ -19,6 +20,8 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 	var parseExpression func() (Regex, error)
 	var parseTerm func() (Regex, error)
 	var parseFactor func() (Regex, error)
+	var parsePrefix func() (Regex, error)
+	var parsePostfix func() (Regex, error)
 	var parseAtom func() (Regex, error)
 
 	// Parse alternation: term ('|' term)*
@@ -64,9 +67,10 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 		return &OrRegex{Chain: alternatives}, nil
 	}
 
-	// Parse concatenation: factor+
+	// Parse concatenation: factor+, with at most one '~' between factors
 	parseTerm = func() (Regex, error) {
 		factors := []Regex{}
+		cut := 0
 
 		for {
 			if err := skipWhitespace(r); err != nil {
@@ -91,6 +95,17 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 				break
 			}
 
+			if b == '~' {
+				if len(factors) == 0 {
+					return nil, fmt.Errorf("'~' must follow part of a sequence")
+				}
+				if cut != 0 {
+					return nil, fmt.Errorf("more than one '~' in a sequence")
+				}
+				cut = len(factors)
+				continue
+			}
+
 			r.UnreadByte()
 
 			factor, err := parseFactor()
@@ -106,11 +121,62 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 		if len(factors) == 1 {
 			return factors[0], nil
 		}
-		return &ChainRegex{Chain: factors}, nil
+		if cut == len(factors) {
+			cut = 0
+		}
+		return &ChainRegex{Chain: factors, Cut: cut}, nil
 	}
 
-	// Parse factor with optional postfix operator
+	// Parse factor with an optional separator: prefix (('%' | '%%') atom)?
 	parseFactor = func() (Regex, error) {
+		factor, err := parsePrefix()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := skipWhitespace(r); err != nil {
+			if err == io.EOF {
+				return factor, nil
+			}
+			return nil, err
+		}
+		if b, err := r.Peek(1); err != nil || b[0] != '%' {
+			return factor, nil
+		}
+		r.Discard(1)
+		trailing := false
+		if b, err := r.Peek(1); err == nil && b[0] == '%' {
+			r.Discard(1)
+			trailing = true
+		}
+
+		separator, err := parseAtom()
+		if err != nil {
+			return nil, err
+		}
+		return &SeparatedRegex{Item: factor, Separator: separator, Trailing: trailing}, nil
+	}
+
+	// Parse a lookahead predicate: ('&' | '!')? postfix
+	parsePrefix = func() (Regex, error) {
+		if err := skipWhitespace(r); err != nil {
+			return nil, err
+		}
+		b, err := r.Peek(1)
+		if err != nil || (b[0] != '&' && b[0] != '!') {
+			return parsePostfix()
+		}
+		r.Discard(1)
+
+		inner, err := parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		return &LookaheadRegex{Negative: b[0] == '!', Inner: inner}, nil
+	}
+
+	// Parse atom with optional postfix operator
+	parsePostfix = func() (Regex, error) {
 		atom, err := parseAtom()
 		if err != nil {
 			return nil, err
@@ -139,6 +205,12 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 			return &MultiplierRegex{RequireOne: true, Inner: atom}, nil
 		case '?':
 			return &OptionalRegex{Inner: atom}, nil
+		case '{':
+			min, max, err := readBounds(r)
+			if err != nil {
+				return nil, err
+			}
+			return &BoundedRegex{Min: min, Max: max, Inner: atom}, nil
 		default:
 			r.UnreadByte()
 			return atom, nil
@@ -151,7 +223,7 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 			return nil, err
 		}
 
-		c, err := r.ReadByte()
+		c, _, err := r.ReadRune()
 		if err != nil {
 			return nil, err
 		}
@@ -178,15 +250,43 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 			return inner, nil
 		}
 
+		if c == '[' {
+			r.UnreadRune()
+			token, err := data.CharClass(r)
+			if err != nil {
+				return nil, err
+			}
+			return &UnitRegex{Token: token}, nil
+		}
+
+		// Handle inline string literal, i"..." matching case insensitively
+		inlineLiteral := func(fold bool) (Regex, error) {
+			literal, err := stringReader(r)()
+			if err != nil {
+				return nil, err
+			}
+			if literal == "" {
+				return nil, fmt.Errorf("empty string literal")
+			}
+			return &UnitRegex{Token: data.InlineLiteral(literal, fold)}, nil
+		}
+		if c == '"' || c == '\'' {
+			r.UnreadRune()
+			return inlineLiteral(false)
+		}
+		if b, err := r.Peek(1); c == 'i' && err == nil && (b[0] == '"' || b[0] == '\'') {
+			return inlineLiteral(true)
+		}
+
 		// Handle identifier (token or construct name)
 		if isValidIdStarter(c) {
 			var s strings.Builder
-			if err := s.WriteByte(c); err != nil {
+			if _, err := s.WriteRune(c); err != nil {
 				return nil, err
 			}
 
 			for {
-				c, err := r.ReadByte()
+				c, _, err := r.ReadRune()
 				if err != nil {
 					if err == io.EOF {
 						break
@@ -194,17 +294,40 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 					return nil, err
 				}
 				if isValidId(c) {
-					if err := s.WriteByte(c); err != nil {
+					if _, err := s.WriteRune(c); err != nil {
 						return nil, err
 					}
 				} else {
-					r.UnreadByte()
+					r.UnreadRune()
 					break
 				}
 			}
 
 			name := s.String()
 
+			// Check if it's a rule template use, which names the construct
+			// added for it
+			if b, err := r.Peek(1); err == nil && b[0] == '<' {
+				r.Discard(1)
+				args, err := readArguments(r)
+				if err != nil {
+					return nil, fmt.Errorf("%s<...>: %v", name, err)
+				}
+				if name, err = data.instantiate(name, args); err != nil {
+					return nil, err
+				}
+			}
+
+			// Check if it's a label
+			if b, err := r.Peek(1); err == nil && b[0] == ':' {
+				r.Discard(1)
+				inner, err := parseFactor()
+				if err != nil {
+					return nil, err
+				}
+				return &LabelRegex{Label: name, Inner: inner}, nil
+			}
+
 			// Check if it's a token
 			for _, token := range data.Tokens {
 				if TokenName(token) == name {
@@ -220,8 +343,10 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 						// Return a reference without expanding (Value will be nil)
 						return &NestedRegex{
 							Construct: Construct{
-								Name:  construct.Name,
-								Value: nil, // nil indicates this is just a reference
+								Name:    construct.Name,
+								Value:   nil, // nil indicates this is just a reference
+								Inline:  construct.Inline,
+								Lexical: construct.Lexical,
 							},
 						}, nil
 					}
@@ -236,8 +361,10 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
 					}
 					return &NestedRegex{
 						Construct: Construct{
-							Name:  construct.Name,
-							Value: regex,
+							Name:    construct.Name,
+							Value:   regex,
+							Inline:  construct.Inline,
+							Lexical: construct.Lexical,
 						},
 					}, nil
 				}
@@ -265,6 +392,10 @@ func createConstructValueWithStack(data *ChiselData, value string, expandStack m
  * (<regex>) -> CapturedRegex
  * <regex>* || <regex>+ -> MultiplierRegex
  * <regex>? -> OptionalRegex
+ * name:<regex> -> LabelRegex
+ * <regex>{m,n} -> BoundedRegex
+ * <regex> % <regex> || <regex> %% <regex> -> SeparatedRegex
+ * &<regex> || !<regex> -> LookaheadRegex
  */
 
 /*
@@ -440,6 +571,10 @@ func RegexToCppPrototype(r Regex) string {
 }
 
 func RegexCall(r Regex, args ...string) string {
+	return fmt.Sprintf("%s(%s)", RegexFunction(r), strings.Join(args, ","))
+}
+
+func RegexFunction(r Regex) string {
 	t := ""
 	count := 0
 	switch v := r.(type) {
@@ -456,18 +591,117 @@ func RegexCall(r Regex, args ...string) string {
 		t = "or"
 		count = v.Count
 	case *CapturedRegex:
-		return RegexCall(v.Inner, args...)
+		return RegexFunction(v.Inner)
 	case *MultiplierRegex:
 		t = "multiplier"
 		count = v.Count
 	case *OptionalRegex:
 		t = "optional"
 		count = v.Count
+	case *LabelRegex:
+		t = "label"
+		count = v.Count
+	case *BoundedRegex:
+		t = "bounded"
+		count = v.Count
+	case *SeparatedRegex:
+		t = "separated"
+		count = v.Count
+	case *LookaheadRegex:
+		t = "lookahead"
+		count = v.Count
 	default:
 		log.Fatalf("Expected a Regex type, got %v.\n", v)
 	}
 
-	return fmt.Sprintf("parse_%s_%d(%s)", t, count, strings.Join(args, ","))
+	return fmt.Sprintf("parse_%s_%d", t, count)
+}
+
+// regexPrologue opens every generated parse_* function.
+func regexPrologue() string {
+	if options.Limits {
+		return "if (!Parser::step(reader)) return false;\nParser::skip(reader);"
+	}
+	return "Parser::skip(reader);"
+}
+
+// RegexSource prints r back in grammar syntax.
+func RegexSource(r Regex) string {
+	group := func(r Regex) string {
+		switch r.(type) {
+		case *ChainRegex, *OrRegex:
+			return "(" + RegexSource(r) + ")"
+		}
+		return RegexSource(r)
+	}
+
+	switch v := r.(type) {
+	case *UnitRegex:
+		if lit, ok := v.Token.(LiteralToken); ok && lit.Inline {
+			if lit.Fold {
+				return "i" + strconv.Quote(lit.Literal)
+			}
+			return strconv.Quote(lit.Literal)
+		}
+		if class, ok := v.Token.(FunctionToken); ok && class.Class != "" {
+			return class.Class
+		}
+		return TokenName(v.Token)
+	case *NestedRegex:
+		return v.Construct.Name
+	case *ChainRegex:
+		parts := []string{}
+		for i, re := range v.Chain {
+			if i != 0 && i == v.Cut {
+				parts = append(parts, "~")
+			}
+			if _, ok := re.(*OrRegex); ok {
+				parts = append(parts, group(re))
+			} else {
+				parts = append(parts, RegexSource(re))
+			}
+		}
+		return strings.Join(parts, " ")
+	case *OrRegex:
+		parts := []string{}
+		for _, re := range v.Chain {
+			parts = append(parts, RegexSource(re))
+		}
+		return strings.Join(parts, " | ")
+	case *CapturedRegex:
+		return RegexSource(v.Inner)
+	case *MultiplierRegex:
+		if v.RequireOne {
+			return group(v.Inner) + "+"
+		}
+		return group(v.Inner) + "*"
+	case *OptionalRegex:
+		return group(v.Inner) + "?"
+	case *LabelRegex:
+		return v.Label + ":" + group(v.Inner)
+	case *BoundedRegex:
+		switch {
+		case v.Min == v.Max:
+			return fmt.Sprintf("%s{%d}", group(v.Inner), v.Min)
+		case v.Max < 0:
+			return fmt.Sprintf("%s{%d,}", group(v.Inner), v.Min)
+		default:
+			return fmt.Sprintf("%s{%d,%d}", group(v.Inner), v.Min, v.Max)
+		}
+	case *SeparatedRegex:
+		op := " % "
+		if v.Trailing {
+			op = " %% "
+		}
+		return group(v.Item) + op + group(v.Separator)
+	case *LookaheadRegex:
+		if v.Negative {
+			return "!" + group(v.Inner)
+		}
+		return "&" + group(v.Inner)
+	default:
+		return ""
+	}
 }
 
 type UnitRegex struct {
@@ -480,35 +714,36 @@ type UnitRegex struct {
 var unitRegexNum = 0
 
 func (r *UnitRegex) RegexToCppFunction() string {
-	if _, ok := r.Token.(SimpleToken); ok {
-		return ""
-	}
-
 	if r.Count != 0 {
 		return ""
 	}
 
 	unitRegexNum++
 	r.Count = unitRegexNum
+	add := "else nodes.emplace_back(std::move(token));"
+	if TokenDropped(r.Token) {
+		add = ""
+	}
 	return fmt.Sprintf(
 		`
 		bool Parser::parse_unit_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
-			Token::skip(reader);
+			%s
+			auto start = Parser::mark(reader);
 			auto token = %s; // already undoes on fail so we gucci
-			if (token) nodes.emplace_back(std::move(token));
+			if (!token) Parser::expect(reader, start, %s);
+			%s
 			return token;
 		}
 		`,
 		r.Count,
+		regexPrologue(),
 		TokenCall(r.Token, "reader"),
+		strconv.Quote(TokenDisplayName(r.Token)),
+		add,
 	)
 }
 
 func (r *UnitRegex) RegexToCppPrototype() string {
-	if _, ok := r.Token.(SimpleToken); ok {
-		return ""
-	}
-
 	if r.Prototyped {
 		return ""
 	}
@@ -550,17 +785,23 @@ func (r *NestedRegex) RegexToCppFunction() string {
 
 	nestedRegexNum++
 	r.Count = nestedRegexNum
+	add := "nodes.emplace_back(construct)"
+	if r.Construct.Inline {
+		add = fmt.Sprintf("Parser::splice(nodes, construct, ParseNode::Type::%s)", r.Construct.Name)
+	}
 	return fmt.Sprintf(
 		`
 		bool Parser::parse_nested_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
-			Token::skip(reader);
+			%s
 			auto construct = %s; // Should automatically undo on fail so we still gucci
-			if (construct) nodes.emplace_back(construct);
+			if (construct) %s;
 			return construct;
 		}
 		`,
 		r.Count,
+		regexPrologue(),
 		r.Construct.Call("reader"),
+		add,
 	)
 }
 
@@ -592,9 +833,13 @@ func (r *NestedRegex) String() string {
 	return s
 }
 
+// ChainRegex matches each of Chain in turn. A non zero Cut is the number of
+// elements before a `~`: once they match, failing the rest also fails the
+// enclosing choice instead of trying its next alternative.
 type ChainRegex struct {
 	Counter
 	Chain []Regex
+	Cut   int
 }
 
 var chainRegexNum = 0
@@ -609,6 +854,7 @@ func (r *ChainRegex) RegexToCppFunction() string {
 
 	var b strings.Builder
 	var chain strings.Builder
+	var committed strings.Builder
 	for i, re := range r.Chain {
 		if re == nil {
 			continue
@@ -617,41 +863,39 @@ func (r *ChainRegex) RegexToCppFunction() string {
 		b.WriteString(re.RegexToCppFunction())
 		b.WriteByte('\n')
 
-		if i < len(r.Chain)-1 {
-			if v, ok := re.(*UnitRegex); ok {
-				if _, ok := v.Token.(SimpleToken); ok {
-					continue
-				}
-			}
-			chain.WriteString(fmt.Sprintf("(%s) && ", RegexCall(re, "reader", "nodes")))
-		} else {
-			if v, ok := re.(*UnitRegex); ok {
-				if _, ok := v.Token.(SimpleToken); ok {
-					continue
-				}
-			}
-			chain.WriteString(fmt.Sprintf("(%s)", RegexCall(re, "reader", "nodes")))
+		part := &chain
+		if r.Cut != 0 && i >= r.Cut {
+			part = &committed
 		}
+		part.WriteString(fmt.Sprintf("(%s) && ", RegexCall(re, "reader", "nodes")))
 	}
 
 	c := strings.Trim(strings.TrimSpace(chain.String()), "&")
+	if c == "" {
+		c = "true"
+	}
+	if rest := strings.Trim(strings.TrimSpace(committed.String()), "&"); rest != "" {
+		c += fmt.Sprintf(";\nif (result && !(%s)) {\nParser::cut = true;\nresult = false;\n}", rest)
+	}
 
 	return fmt.Sprintf(
 		`
 		%s
 		bool Parser::parse_chain_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
-			Token::skip(reader);
-			auto start = reader.tellg();
+			%s
+			auto start = Parser::mark(reader);
+			auto size = nodes.size();
 			bool result = %s;
 			if (!result) {
-				reader.clear();
-				reader.seekg(start, std::ios::beg);
+				Parser::restore(reader, start);
+				Parser::truncate(nodes, size);
 			}
 			return result;
 		}
 		`,
 		b.String(),
 		r.Count,
+		regexPrologue(),
 		c,
 	)
 }
@@ -692,6 +936,7 @@ func (r *ChainRegex) String() string {
 		fmt.Sprintf("%s.Count = %d\n", after, r.Count) +
 		fmt.Sprintf("%s.Prototyped = %v\n", after, r.Prototyped) +
 		fmt.Sprintf("%s.Chain = %v\n", after, r.Chain) +
+		fmt.Sprintf("%s.Cut = %d\n", after, r.Cut) +
 		before + "}"
 	ChiselTabs--
 	return s
@@ -714,7 +959,7 @@ func (r *OrRegex) RegexToCppFunction() string {
 
 	var b strings.Builder
 	var chain strings.Builder
-	for i, re := range r.Chain {
+	for _, re := range r.Chain {
 		if re == nil {
 			continue
 		}
@@ -722,21 +967,13 @@ func (r *OrRegex) RegexToCppFunction() string {
 		b.WriteString(re.RegexToCppFunction())
 		b.WriteByte('\n')
 
-		if i < len(r.Chain)-1 {
-			if v, ok := re.(*UnitRegex); ok {
-				if _, ok := v.Token.(SimpleToken); ok {
-					continue
-				}
-			}
-			chain.WriteString(fmt.Sprintf("(%s) || ", RegexCall(re, "reader", "nodes")))
+		// An alternative that failed past its cut ends the choice
+		if chain.Len() != 0 {
+			chain.WriteString("(!Parser::cut && ")
 		} else {
-			if v, ok := re.(*UnitRegex); ok {
-				if _, ok := v.Token.(SimpleToken); ok {
-					continue
-				}
-			}
-			chain.WriteString(fmt.Sprintf("(%s)", RegexCall(re, "reader", "nodes")))
+			chain.WriteString("(")
 		}
+		chain.WriteString(fmt.Sprintf("%s) || ", RegexCall(re, "reader", "nodes")))
 	}
 
 	c := strings.Trim(strings.TrimSpace(chain.String()), "|")
@@ -745,18 +982,19 @@ func (r *OrRegex) RegexToCppFunction() string {
 		`
 		%s
 		bool Parser::parse_or_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
-			Token::skip(reader);
-			auto start = reader.tellg();
+			%s
+			auto start = Parser::mark(reader);
 			bool result = %s;
 			if (!result) {
-				reader.clear();
-				reader.seekg(start, std::ios::beg);
+				Parser::restore(reader, start);
 			}
+			Parser::cut = false;
 			return result;
 		}
 		`,
 		b.String(),
 		r.Count,
+		regexPrologue(),
 		c,
 	)
 }
@@ -844,24 +1082,23 @@ func (r *MultiplierRegex) RegexToCppFunction() string {
 			`
 			%s
 			bool Parser::parse_multiplier_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
-				Token::skip(reader);
-				auto start = reader.tellg();
+				%s
+				auto start = Parser::mark(reader);
 				auto first = %s;
 				if (!first) {
-					reader.clear();
-					reader.seekg(start, std::ios::beg);
+					Parser::restore(reader, start);
 					return false;
 				}
 				for (auto result = first; result; result = %s) {
-					start = reader.tellg();
+					start = Parser::mark(reader);
 				}
-				reader.clear();
-				reader.seekg(start, std::ios::beg);
-				return true;
+				Parser::restore(reader, start);
+				return !Parser::cut;
 			}
 			`,
 			r.Inner.RegexToCppFunction(),
 			r.Count,
+			regexPrologue(),
 			RegexCall(r.Inner, "reader", "nodes"),
 			RegexCall(r.Inner, "reader", "nodes"),
 		)
@@ -871,18 +1108,18 @@ func (r *MultiplierRegex) RegexToCppFunction() string {
 		`
 		%s
 		bool Parser::parse_multiplier_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
-			Token::skip(reader);
-			auto start = reader.tellg();
+			%s
+			auto start = Parser::mark(reader);
 			for (auto result = %s; result; result = %s) {
-				start = reader.tellg();
+				start = Parser::mark(reader);
 			}
-			reader.clear();
-			reader.seekg(start, std::ios::beg);
-			return true;
+			Parser::restore(reader, start);
+			return !Parser::cut;
 		}
 		`,
 		r.Inner.RegexToCppFunction(),
 		r.Count,
+		regexPrologue(),
 		RegexCall(r.Inner, "reader", "nodes"),
 		RegexCall(r.Inner, "reader", "nodes"),
 	)
@@ -937,18 +1174,18 @@ func (r *OptionalRegex) RegexToCppFunction() string {
 		`
 		%s
 		bool Parser::parse_optional_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
-			Token::skip(reader);
-			auto start = reader.tellg();
+			%s
+			auto start = Parser::mark(reader);
 			if (!%s) {
-				reader.clear();
-				reader.seekg(start, std::ios::beg);
-				return true;
+				Parser::restore(reader, start);
+				return !Parser::cut;
 			}
 			return true;
 		}
 		`,
 		r.Inner.RegexToCppFunction(),
 		r.Count,
+		regexPrologue(),
 		RegexCall(r.Inner, "reader", "nodes"),
 	)
 }
@@ -982,3 +1219,417 @@ func (r *OptionalRegex) String() string {
 	ChiselTabs--
 	return s
 }
+
+// LabelRegex names the children matched by Inner, as in `name:ID`.
+type LabelRegex struct {
+	Counter
+	Label string
+	Inner Regex
+}
+
+var labelRegexNum = 0
+
+func (r *LabelRegex) RegexToCppFunction() string {
+	if r.Count != 0 {
+		return ""
+	}
+
+	labelRegexNum++
+	r.Count = labelRegexNum
+	return fmt.Sprintf(
+		`
+		%s
+		bool Parser::parse_label_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
+			%s
+			auto size = nodes.size();
+			if (!%s) {
+				return false;
+			}
+			for (auto i = size; i < nodes.size(); ++i) {
+				nodes[i].set_label(%s);
+			}
+			return true;
+		}
+		`,
+		r.Inner.RegexToCppFunction(),
+		r.Count,
+		regexPrologue(),
+		RegexCall(r.Inner, "reader", "nodes"),
+		strconv.Quote(r.Label),
+	)
+}
+
+func (r *LabelRegex) RegexToCppPrototype() string {
+	if r.Prototyped {
+		return ""
+	}
+
+	r.Prototyped = true
+	return fmt.Sprintf(
+		`
+		%s
+		static bool %s;
+		`,
+		r.Inner.RegexToCppPrototype(),
+		RegexCall(r, "std::istream &", "std::vector<Parser::Node> &"),
+	)
+}
+
+func (r *LabelRegex) String() string {
+	before := strings.Repeat("\t", ChiselTabs)
+	ChiselTabs++
+	after := before + "\t"
+
+	s := "Label {\n" +
+		fmt.Sprintf("%s.Count = %d\n", after, r.Count) +
+		fmt.Sprintf("%s.Prototyped = %v\n", after, r.Prototyped) +
+		fmt.Sprintf("%s.Label = %s\n", after, r.Label) +
+		fmt.Sprintf("%s.Inner = %s\n", after, r.Inner.String()) +
+		before + "}"
+	ChiselTabs--
+	return s
+}
+
+// readBounds reads the rest of `{n}`, `{m,}` or `{m,n}` after the '{'. An
+// open upper bound is returned as -1.
+func readBounds(r *bufio.Reader) (int, int, error) {
+	number := func() (int, bool, error) {
+		if err := skipWhitespace(r); err != nil {
+			return 0, false, err
+		}
+		var s strings.Builder
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, false, err
+			}
+			if b < '0' || b > '9' {
+				r.UnreadByte()
+				break
+			}
+			s.WriteByte(b)
+		}
+		if s.Len() == 0 {
+			return 0, false, nil
+		}
+		n, err := strconv.Atoi(s.String())
+		return n, true, err
+	}
+	next := func() (byte, error) {
+		if err := skipWhitespace(r); err != nil {
+			return 0, err
+		}
+		return r.ReadByte()
+	}
+
+	min, ok, err := number()
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		return 0, 0, fmt.Errorf("expected a repetition count after '{'")
+	}
+	max := min
+
+	b, err := next()
+	if err != nil {
+		return 0, 0, err
+	}
+	if b == ',' {
+		n, ok, err := number()
+		if err != nil {
+			return 0, 0, err
+		}
+		max = -1
+		if ok {
+			max = n
+		}
+		if b, err = next(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if b != '}' {
+		return 0, 0, fmt.Errorf("expected '}' to close a repetition, got '%c'", b)
+	}
+	if max >= 0 && (max < min || max == 0) {
+		return 0, 0, fmt.Errorf("bad repetition bounds {%d,%d}", min, max)
+	}
+	return min, max, nil
+}
+
+// BoundedRegex matches Inner at least Min and at most Max times, or without
+// an upper bound when Max is negative.
+type BoundedRegex struct {
+	Counter
+	Min   int
+	Max   int
+	Inner Regex
+}
+
+var boundedRegexNum = 0
+
+func (r *BoundedRegex) RegexToCppFunction() string {
+	if r.Count != 0 {
+		return ""
+	}
+
+	boundedRegexNum++
+	r.Count = boundedRegexNum
+	more := "true"
+	if r.Max >= 0 {
+		more = fmt.Sprintf("count < %d", r.Max)
+	}
+	return fmt.Sprintf(
+		`
+		%s
+		bool Parser::parse_bounded_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
+			%s
+			auto start = Parser::mark(reader);
+			auto size = nodes.size();
+			size_t count = 0;
+			while (%s) {
+				auto before = Parser::mark(reader);
+				if (!%s) {
+					Parser::restore(reader, before);
+					if (Parser::cut)
+						return false;
+					break;
+				}
+				++count;
+				// An empty match would match as often as needed
+				if (Parser::mark(reader) == before) {
+					if (count < %d)
+						count = %d;
+					break;
+				}
+			}
+			if (count < %d) {
+				Parser::restore(reader, start);
+				Parser::truncate(nodes, size);
+				return false;
+			}
+			return true;
+		}
+		`,
+		r.Inner.RegexToCppFunction(),
+		r.Count,
+		regexPrologue(),
+		more,
+		RegexCall(r.Inner, "reader", "nodes"),
+		r.Min,
+		r.Min,
+		r.Min,
+	)
+}
+
+func (r *BoundedRegex) RegexToCppPrototype() string {
+	if r.Prototyped {
+		return ""
+	}
+
+	r.Prototyped = true
+	return fmt.Sprintf(
+		`
+		%s
+		static bool %s;
+		`,
+		r.Inner.RegexToCppPrototype(),
+		RegexCall(r, "std::istream &", "std::vector<Parser::Node> &"),
+	)
+}
+
+func (r *BoundedRegex) String() string {
+	before := strings.Repeat("\t", ChiselTabs)
+	ChiselTabs++
+	after := before + "\t"
+
+	s := "Bounded {\n" +
+		fmt.Sprintf("%s.Count = %d\n", after, r.Count) +
+		fmt.Sprintf("%s.Prototyped = %v\n", after, r.Prototyped) +
+		fmt.Sprintf("%s.Min = %d\n", after, r.Min) +
+		fmt.Sprintf("%s.Max = %d\n", after, r.Max) +
+		fmt.Sprintf("%s.Inner = %s\n", after, r.Inner.String()) +
+		before + "}"
+	ChiselTabs--
+	return s
+}
+
+// SeparatedRegex matches one or more Item separated by Separator, as in
+// `EXPR % COMMA`. Trailing (`EXPR %% COMMA`) also takes a final separator.
+type SeparatedRegex struct {
+	Counter
+	Item      Regex
+	Separator Regex
+	Trailing  bool
+}
+
+var separatedRegexNum = 0
+
+func (r *SeparatedRegex) RegexToCppFunction() string {
+	if r.Count != 0 {
+		return ""
+	}
+
+	separatedRegexNum++
+	r.Count = separatedRegexNum
+	dangling := `
+		Parser::restore(reader, before);
+		Parser::truncate(nodes, size);
+	`
+	if r.Trailing {
+		dangling = "// The separator was trailing"
+	}
+
+	return fmt.Sprintf(
+		`
+		%s
+		%s
+		bool Parser::parse_separated_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
+			%s
+			auto start = Parser::mark(reader);
+			if (!%s) {
+				Parser::restore(reader, start);
+				return false;
+			}
+			for (;;) {
+				auto before = Parser::mark(reader);
+				auto size = nodes.size();
+				if (!%s) {
+					Parser::restore(reader, before);
+					break;
+				}
+				if (!%s) {
+					%s
+					break;
+				}
+				if (Parser::mark(reader) == before) {
+					break;
+				}
+			}
+			return !Parser::cut;
+		}
+		`,
+		r.Item.RegexToCppFunction(),
+		r.Separator.RegexToCppFunction(),
+		r.Count,
+		regexPrologue(),
+		RegexCall(r.Item, "reader", "nodes"),
+		RegexCall(r.Separator, "reader", "nodes"),
+		RegexCall(r.Item, "reader", "nodes"),
+		dangling,
+	)
+}
+
+func (r *SeparatedRegex) RegexToCppPrototype() string {
+	if r.Prototyped {
+		return ""
+	}
+
+	r.Prototyped = true
+	return fmt.Sprintf(
+		`
+		%s
+		%s
+		static bool %s;
+		`,
+		r.Item.RegexToCppPrototype(),
+		r.Separator.RegexToCppPrototype(),
+		RegexCall(r, "std::istream &", "std::vector<Parser::Node> &"),
+	)
+}
+
+func (r *SeparatedRegex) String() string {
+	before := strings.Repeat("\t", ChiselTabs)
+	ChiselTabs++
+	after := before + "\t"
+
+	s := "Separated {\n" +
+		fmt.Sprintf("%s.Count = %d\n", after, r.Count) +
+		fmt.Sprintf("%s.Prototyped = %v\n", after, r.Prototyped) +
+		fmt.Sprintf("%s.Item = %s\n", after, r.Item.String()) +
+		fmt.Sprintf("%s.Separator = %s\n", after, r.Separator.String()) +
+		fmt.Sprintf("%s.Trailing = %v\n", after, r.Trailing) +
+		before + "}"
+	ChiselTabs--
+	return s
+}
+
+// LookaheadRegex tests Inner without consuming input or adding children.
+// Negative succeeds only when Inner fails.
+type LookaheadRegex struct {
+	Counter
+	Negative bool
+	Inner    Regex
+}
+
+var lookaheadRegexNum = 0
+
+func (r *LookaheadRegex) RegexToCppFunction() string {
+	if r.Count != 0 {
+		return ""
+	}
+
+	lookaheadRegexNum++
+	r.Count = lookaheadRegexNum
+	// What a negated test expected says nothing about the input
+	save, result := "", "return matched;"
+	if r.Negative {
+		save = "auto saved = Parser::error;"
+		result = "Parser::error = saved;\nreturn !matched;"
+		if options.Limits {
+			result = "Parser::error = saved;\nreturn !matched && !Parser::aborted;"
+		}
+	}
+	return fmt.Sprintf(
+		`
+		%s
+		bool Parser::parse_lookahead_%d(std::istream &reader, std::vector<Parser::Node> &nodes) {
+			%s
+			auto start = Parser::mark(reader);
+			%s
+			std::vector<Node> ignored;
+			bool matched = %s;
+			Parser::restore(reader, start);
+			Parser::cut = false;
+			%s
+		}
+		`,
+		r.Inner.RegexToCppFunction(),
+		r.Count,
+		regexPrologue(),
+		save,
+		RegexCall(r.Inner, "reader", "ignored"),
+		result,
+	)
+}
+
+func (r *LookaheadRegex) RegexToCppPrototype() string {
+	if r.Prototyped {
+		return ""
+	}
+
+	r.Prototyped = true
+	return fmt.Sprintf(
+		`
+		%s
+		static bool %s;
+		`,
+		r.Inner.RegexToCppPrototype(),
+		RegexCall(r, "std::istream &", "std::vector<Parser::Node> &"),
+	)
+}
+
+func (r *LookaheadRegex) String() string {
+	before := strings.Repeat("\t", ChiselTabs)
+	ChiselTabs++
+	after := before + "\t"
+
+	s := "Lookahead {\n" +
+		fmt.Sprintf("%s.Count = %d\n", after, r.Count) +
+		fmt.Sprintf("%s.Prototyped = %v\n", after, r.Prototyped) +
+		fmt.Sprintf("%s.Negative = %v\n", after, r.Negative) +
+		fmt.Sprintf("%s.Inner = %s\n", after, r.Inner.String()) +
+		before + "}"
+	ChiselTabs--
+	return s
+}
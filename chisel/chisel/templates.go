@@ -0,0 +1,226 @@
+package chisel
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A rule template such as `paren_list<X> = LPAREN (X (COMMA X)*)? RPAREN;`
+// is kept as a SimpleConstruct with Params, and only turned into constructs
+// when used: `paren_list<EXPRESSION>` adds `paren_list_EXPRESSION`, whose
+// value is the template's with every X replaced by EXPRESSION.
+
+// Instantiating more than this many constructs means a template keeps using
+// itself with new arguments, as in `t<X> = t<paren_list<X>>;`.
+const maxInstances = 1024
+
+// readParameters reads the `<X, Y>` following a rule template's name, or
+// nothing for a plain construct.
+func readParameters(r *bufio.Reader) ([]string, error) {
+	if err := skipWhitespace(r); err != nil {
+		return nil, err
+	}
+	if b, err := r.Peek(1); err != nil || b[0] != '<' {
+		return nil, nil
+	}
+	r.Discard(1)
+
+	params := []string{}
+	for {
+		param, err := syntaxReader(r)()
+		if err != nil {
+			return nil, err
+		}
+		if syntaxTokenType([]byte(param)) != ID {
+			return nil, fmt.Errorf("expected a template parameter name, got '%s'", param)
+		}
+		for _, p := range params {
+			if p == param {
+				return nil, fmt.Errorf("template parameter '%s' given twice", param)
+			}
+		}
+		params = append(params, param)
+
+		if err := skipWhitespace(r); err != nil {
+			return nil, err
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == '>' {
+			return params, nil
+		}
+		if b != ',' {
+			return nil, fmt.Errorf("expected ',' or '>' after template parameter '%s', got '%c'", param, b)
+		}
+	}
+}
+
+// readArguments reads the arguments of a template use up to its closing '>',
+// the '<' having been read. Each argument is a name, or another template
+// use.
+func readArguments(r *bufio.Reader) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	depth := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("expected closing '>'")
+		}
+
+		if depth == 0 && (b == ',' || b == '>') {
+			s := strings.TrimSpace(arg.String())
+			if !isTemplateArgument(s) {
+				return nil, fmt.Errorf("bad template argument: '%s'", s)
+			}
+			args = append(args, s)
+			arg.Reset()
+			if b == '>' {
+				return args, nil
+			}
+			continue
+		}
+
+		switch b {
+		case '<':
+			depth++
+		case '>':
+			depth--
+		}
+		arg.WriteByte(b)
+	}
+}
+
+func isTemplateArgument(s string) bool {
+	name, rest, nested := strings.Cut(s, "<")
+	if name == "" || (nested && !strings.HasSuffix(rest, ">")) {
+		return false
+	}
+	name = strings.TrimSpace(name)
+	for i, c := range name {
+		if (i == 0 && !isValidIdStarter(c)) || !isValidId(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceName gives the construct for `name<args>` a name of its own, as in
+// `paren_list_EXPRESSION` or `list_paren_list_ID` for `list<paren_list<ID>>`.
+func instanceName(name string, args []string) string {
+	mangle := strings.NewReplacer("<", "_", ",", "_", ">", "")
+	parts := []string{name}
+	for _, arg := range args {
+		arg = strings.Join(strings.FieldsFunc(arg, unicode.IsSpace), "")
+		parts = append(parts, mangle.Replace(arg))
+	}
+	return strings.Join(parts, "_")
+}
+
+// substituteParameters replaces the parameters named in a template's value,
+// leaving string literals, character classes and labels alone.
+func substituteParameters(value string, params, args []string) string {
+	var b strings.Builder
+	var quote rune
+	slash := false
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		if quote != 0 {
+			b.WriteRune(c)
+			if slash {
+				slash = false
+			} else if c == '\\' {
+				slash = true
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' || c == '\'' {
+			quote = c
+			b.WriteRune(c)
+			continue
+		}
+		if c == '[' {
+			quote = ']'
+			b.WriteRune(c)
+			continue
+		}
+		if !isValidIdStarter(c) {
+			b.WriteRune(c)
+			continue
+		}
+
+		j := i
+		for j < len(runes) && isValidId(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		i = j - 1
+		if j < len(runes) && runes[j] == ':' {
+			b.WriteString(word)
+			continue
+		}
+		for k, param := range params {
+			if param == word {
+				word = args[k]
+				break
+			}
+		}
+		b.WriteString(word)
+	}
+	return b.String()
+}
+
+func (d *ChiselData) findTemplate(name string) *SimpleConstruct {
+	for i := range d.Templates {
+		if d.Templates[i].Name == name {
+			return &d.Templates[i]
+		}
+	}
+	return nil
+}
+
+// instantiate adds the construct for `name<args>` unless an earlier use
+// already did, returning its name.
+func (d *ChiselData) instantiate(name string, args []string) (string, error) {
+	t := d.findTemplate(name)
+	if t == nil {
+		return "", fmt.Errorf("failed to find rule template of name: '%s'", name)
+	}
+	if len(args) != len(t.Params) {
+		return "", fmt.Errorf("rule template %s takes %d arguments, got %d", name, len(t.Params), len(args))
+	}
+
+	instance := instanceName(name, args)
+	if d.Instances[instance] {
+		return instance, nil
+	}
+	if d.hasSimpleConstruct(instance) || d.findToken(instance) != nil {
+		return "", fmt.Errorf("%s<%s>: its construct name %s is already taken", name, strings.Join(args, ", "), instance)
+	}
+	if len(d.Instances) >= maxInstances {
+		return "", fmt.Errorf("%s<%s>: rule templates keep using themselves with new arguments", name, strings.Join(args, ", "))
+	}
+
+	if d.Instances == nil {
+		d.Instances = map[string]bool{}
+	}
+	d.Instances[instance] = true
+	d.AddSimpleConstruct(SimpleConstruct{
+		Name:    instance,
+		Value:   substituteParameters(t.Value, t.Params, args),
+		Type:    t.Type,
+		Action:  t.Action,
+		Inline:  t.Inline,
+		Skip:    t.Skip,
+		NoSkip:  t.NoSkip,
+		Lexical: t.Lexical,
+	})
+	return instance, nil
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"unicode"
 )
 
 type Token interface {
@@ -39,20 +40,58 @@ func TokenName(t Token) string {
 	}
 }
 
+// TokenDropped reports whether matches of t are left out of the tree.
+func TokenDropped(t Token) bool {
+	switch v := t.(type) {
+	case LiteralToken:
+		return v.Drop
+	case FunctionToken:
+		return v.Drop
+	default:
+		return false
+	}
+}
+
+// TokenDisplayName names t in error messages: inline literals and character
+// classes show their text.
+func TokenDisplayName(t Token) string {
+	if v, ok := t.(FunctionToken); ok && v.Class != "" {
+		return v.Class
+	}
+	if v, ok := t.(LiteralToken); ok && v.Inline {
+		if v.Fold {
+			return "i'" + v.Literal + "'"
+		}
+		return "'" + v.Literal + "'"
+	}
+	return TokenName(t)
+}
+
 func TokenPrototype(t Token, skip bool) string {
+	return tokenPrototype(t, skip, "token_"+TokenName(t))
+}
+
+// tokenPrototype declares the function matching t as `fn`.
+func tokenPrototype(t Token, skip bool, fn string) string {
 	switch v := t.(type) {
 	case SimpleToken:
-		return ""
+		if skip {
+			return fmt.Sprintf("static void %s(std::istream &);", fn)
+		}
+		return fmt.Sprintf("static Token %s(std::istream &);", fn)
 	case LiteralToken:
 		if skip {
-			return fmt.Sprintf("static void token_%s(std::istream &);", v.Name)
+			return fmt.Sprintf("static void %s(std::istream &);", fn)
 		}
-		return fmt.Sprintf("static Token token_%s(std::istream &);", v.Name)
+		return fmt.Sprintf("static Token %s(std::istream &);", fn)
 	case FunctionToken:
 		if skip {
-			return fmt.Sprintf("static void token_%s(std::istream &);", v.Name)
+			return fmt.Sprintf("static void %s(std::istream &);", fn)
+		}
+		if v.Identifier || v.Type != "" {
+			return fmt.Sprintf("static Token scan_%s(std::istream &);\nstatic Token %s(std::istream &);", v.Name, fn)
 		}
-		return fmt.Sprintf("static Token token_%s(std::istream &);", v.Name)
+		return fmt.Sprintf("static Token %s(std::istream &);", fn)
 	default:
 		return ""
 	}
@@ -61,7 +100,7 @@ func TokenPrototype(t Token, skip bool) string {
 func TokenCall(t Token, args ...string) string {
 	switch v := t.(type) {
 	case SimpleToken:
-		return ""
+		return fmt.Sprintf("Token::token_%s(%s)", v.Name, strings.Join(args, ","))
 	case LiteralToken:
 		return fmt.Sprintf("Token::token_%s(%s)", v.Name, strings.Join(args, ","))
 	case FunctionToken:
@@ -71,15 +110,45 @@ func TokenCall(t Token, args ...string) string {
 	}
 }
 
-func TokenDefinition(t Token, skip bool) string {
+func TokenFunction(t Token) string {
 	switch v := t.(type) {
 	case SimpleToken:
+		return fmt.Sprintf("Token::token_%s", v.Name)
+	case LiteralToken:
+		return fmt.Sprintf("Token::token_%s", v.Name)
+	case FunctionToken:
+		return fmt.Sprintf("Token::token_%s", v.Name)
+	default:
 		return ""
+	}
+}
+
+func TokenDefinition(t Token, skip bool) string {
+	return tokenDefinition(t, skip, "token_"+TokenName(t))
+}
+
+// tokenDefinition defines the function matching t as `fn`.
+func tokenDefinition(t Token, skip bool, fn string) string {
+	switch v := t.(type) {
+	case SimpleToken:
+		if skip {
+			return fmt.Sprintf(
+				"void Token::%s(std::istream &reader) {\nToken::scan_external(reader, Token::Type::%s);\n}\n",
+				fn, v.Name,
+			)
+		}
+		return fmt.Sprintf(
+			"Token Token::%s(std::istream &reader) {\nreturn Token::scan_external(reader, Token::Type::%s);\n}\n",
+			fn, v.Name,
+		)
 	case LiteralToken:
+		if v.Fold {
+			return foldedLiteralDefinition(v, skip, fn)
+		}
 		t := ""
 		if skip {
 			t = `
-			void Token::token_{{.Name}}(std::istream &reader) {
+			void Token::{{.Func}}(std::istream &reader) {
 				char buf[{{.Len}}];
 				reader.read(buf, {{.Len}});
 				auto n = reader.gcount();
@@ -95,7 +164,7 @@ func TokenDefinition(t Token, skip bool) string {
 			`
 		} else {
 			t = `
-			Token Token::token_{{.Name}}(std::istream &reader) {
+			Token Token::{{.Func}}(std::istream &reader) {
 				char buf[{{.Len}}];
 				reader.read(buf, {{.Len}});
 				auto n = reader.gcount();
@@ -104,8 +173,15 @@ func TokenDefinition(t Token, skip bool) string {
 					reader.seekg(-n, std::ios::cur);
 					return Token::failed;
 				}
-				if (strncmp(buf, {{.Literal}}, {{.Len}}) == 0)
+				if (strncmp(buf, {{.Literal}}, {{.Len}}) == 0) {
+					{{if .Keyword}}
+					if (!Token::at_word_end(reader)) {
+						reader.seekg(-{{.Len}}, std::ios::cur);
+						return Token::failed;
+					}
+					{{end}}
 					return Token(Token::Type::{{.Name}}, nullptr);
+				}
 				reader.clear();
 				reader.seekg(-{{.Len}}, std::ios::cur);
 				return Token::failed;
@@ -117,28 +193,122 @@ func TokenDefinition(t Token, skip bool) string {
 		var s strings.Builder
 		err := templ.Execute(&s, map[string]any{
 			"Name":    v.Name,
+			"Func":    fn,
 			"Literal": strconv.Quote(v.Literal),
 			"Len":     len(v.Literal),
+			"Keyword": v.Keyword && !skip,
 		})
 		if err != nil {
 			log.Fatal(err)
 		}
 		return s.String()
 	case FunctionToken:
-		return fmt.Sprintf("%s Token::token_%s %s", func() string {
+		if (v.Identifier || v.Type != "") && !skip {
+			return functionTokenWrapper(v, fn)
+		}
+		return fmt.Sprintf("%s Token::%s %s", func() string {
 			if skip {
 				return "void"
 			}
 			return "Token"
-		}(), v.Name, v.Code)
+		}(), fn, v.Code)
 	default:
 		return ""
 	}
 }
 
+// functionTokenWrapper keeps the user code as scan_NAME and wraps it in a
+// token_NAME (or fn) that rejects keywords and converts the value of typed
+// tokens.
+func functionTokenWrapper(v FunctionToken, fn string) string {
+	checks := []string{}
+	if v.Identifier {
+		checks = append(checks, "Token::is_keyword(reader, start)")
+	}
+	if v.Type != "" {
+		checks = append(checks, fmt.Sprintf("!Token::convert_%s(token)", v.Type))
+	}
+
+	return fmt.Sprintf(
+		`
+		Token Token::scan_%s %s
+		Token Token::%s(std::istream &reader) {
+			auto start = reader.tellg();
+			auto token = Token::scan_%s(reader);
+			if (token && (%s)) {
+				reader.clear();
+				reader.seekg(start, std::ios::beg);
+				return Token::failed;
+			}
+			return token;
+		}
+		`,
+		v.Name,
+		v.Code,
+		fn,
+		v.Name,
+		strings.Join(checks, " || "),
+	)
+}
+
+// foldedLiteralDefinition matches v.Literal one UTF-8 code point at a time,
+// accepting every code point in the simple case folding orbit of each.
+func foldedLiteralDefinition(v LiteralToken, skip bool, fn string) string {
+	var match strings.Builder
+	for _, c := range v.Literal {
+		cases := []string{}
+		for f := c; ; {
+			cases = append(cases, fmt.Sprintf("c == 0x%x", f))
+			if f = unicode.SimpleFold(f); f == c {
+				break
+			}
+		}
+		match.WriteString(fmt.Sprintf("Token::read_utf8(reader, c) && (%s) &&\n", strings.Join(cases, " || ")))
+	}
+	if v.Keyword && !skip {
+		match.WriteString("Token::at_word_end(reader) &&\n")
+	}
+	match.WriteString("true")
+
+	if skip {
+		return fmt.Sprintf(
+			`
+			void Token::%s(std::istream &reader) {
+				auto start = reader.tellg();
+				char32_t c;
+				bool match = %s;
+				if (match) return;
+				reader.clear();
+				reader.seekg(start, std::ios::beg);
+			}
+			`,
+			fn,
+			match.String(),
+		)
+	}
+	return fmt.Sprintf(
+		`
+		Token Token::%s(std::istream &reader) {
+			auto start = reader.tellg();
+			char32_t c;
+			bool match = %s;
+			if (match) return Token(Token::Type::%s, nullptr);
+			reader.clear();
+			reader.seekg(start, std::ios::beg);
+			return Token::failed;
+		}
+		`,
+		fn,
+		match.String(),
+		v.Name,
+	)
+}
+
 var prototypedTokens = map[string]bool{}
 var createdTokens = map[string]bool{}
 
+// SimpleToken is a `tok NAME` without a body: an external token, matched by
+// the scanner the program registers with Parser::set_external_scanner.
 type SimpleToken struct {
 	Name string
 }
@@ -149,21 +319,243 @@ type LiteralToken struct {
 	Name       string
 	Literal    string
 	Precedence int
+
+	// Inline is set for tokens created from string literals in constructs.
+	Inline bool
+
+	// Keyword literals only match when not followed by an identifier character.
+	Keyword bool
+
+	// Fold matches the literal ignoring (Unicode simple) case.
+	Fold bool
+
+	// Drop leaves matches out of the tree.
+	Drop bool
+
+	// Push names the lexer mode a match enters, and Pop leaves the current
+	// one first.
+	Push string
+	Pop  bool
 }
 
 func (t LiteralToken) TokenFunc() {}
 
+var literalCharNames = map[byte]string{
+	'(':  "LPAREN",
+	')':  "RPAREN",
+	'{':  "LBRACE",
+	'}':  "RBRACE",
+	'[':  "LBRACKET",
+	']':  "RBRACKET",
+	',':  "COMMA",
+	';':  "SEMI",
+	':':  "COLON",
+	'.':  "DOT",
+	'+':  "PLUS",
+	'-':  "MINUS",
+	'*':  "STAR",
+	'/':  "SLASH",
+	'%':  "PERCENT",
+	'=':  "EQ",
+	'<':  "LT",
+	'>':  "GT",
+	'!':  "BANG",
+	'&':  "AMP",
+	'|':  "PIPE",
+	'^':  "CARET",
+	'~':  "TILDE",
+	'?':  "QUESTION",
+	'@':  "AT",
+	'#':  "HASH",
+	'$':  "DOLLAR",
+	'\'': "QUOTE",
+	'"':  "DQUOTE",
+	'\\': "BACKSLASH",
+	'`':  "BACKTICK",
+}
+
+// literalName derives an enum name for an inline literal: "while" becomes
+// LIT_WHILE and "->" becomes LIT_MINUS_GT.
+func literalName(literal string) string {
+	word := true
+	for i, c := range literal {
+		word = word && (isValidId(c) && (i != 0 || isValidIdStarter(c)))
+	}
+	if word {
+		return "LIT_" + strings.ToUpper(literal)
+	}
+
+	parts := []string{}
+	for i := 0; i < len(literal); i++ {
+		name, ok := literalCharNames[literal[i]]
+		if !ok {
+			return ""
+		}
+		parts = append(parts, name)
+	}
+	return "LIT_" + strings.Join(parts, "_")
+}
+
+// InlineLiteral returns the token matching `literal`, declaring an anonymous
+// LiteralToken the first time a literal is used.
+func (d *ChiselData) InlineLiteral(literal string, fold bool) Token {
+	for _, token := range d.Tokens {
+		if v, ok := token.(LiteralToken); ok && v.Literal == literal && v.Fold == fold {
+			return v
+		}
+	}
+
+	base := literalName(literal)
+	name := base
+	if base == "" {
+		base = "LIT"
+		name = "LIT_1"
+	}
+	for i := 2; d.findToken(name) != nil || d.hasSimpleConstruct(name); i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+
+	token := LiteralToken{
+		Name:    name,
+		Literal: literal,
+		Inline:  true,
+		Fold:    fold,
+	}
+	d.AddToken(token)
+	return token
+}
+
 type FunctionToken struct {
 	Name       string
 	Code       string
 	Precedence int
+
+	// Identifier rejects any match spelling a declared keyword.
+	Identifier bool
+
+	// Type is the value type the token text is converted to, one of
+	// valueTypes, or empty for plain text tokens.
+	Type string
+
+	// Drop leaves matches out of the tree.
+	Drop bool
+
+	// Push names the lexer mode a match enters, and Pop leaves the current
+	// one first.
+	Push string
+	Pop  bool
+
+	// Layout names the layout token of the @newline, @indent and @dedent
+	// built ins.
+	Layout string
+
+	// Class is the source of an inline character class, as in `[0-9]`.
+	Class string
+}
+
+// valueTypes maps the value types of tokens and constructs to C++.
+var valueTypes = map[string]string{
+	"int64":  "int64_t",
+	"double": "double",
+	"string": "std::string",
+	"bool":   "bool",
+}
+
+// readValueType reads an optional `: type` after a token or construct name.
+func readValueType(r *bufio.Reader) (string, error) {
+	if err := skipWhitespace(r); err != nil {
+		return "", err
+	}
+	if b, err := r.Peek(1); err != nil || b[0] != ':' {
+		return "", nil
+	}
+	r.Discard(1)
+
+	typ, err := syntaxReader(r)()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := valueTypes[typ]; !ok {
+		return "", fmt.Errorf("unknown token value type: '%s'", typ)
+	}
+	return typ, nil
 }
 
 func (t FunctionToken) TokenFunc() {}
 
-func createToken(r *bufio.Reader) (Token, error) {
-	// precedence? name = value
-	// precedence? name <- precedence does not matter
+func createToken(r *bufio.Reader, skip bool) (Token, error) {
+	// attributes? precedence? name = value
+	// attributes? precedence? name <- precedence does not matter
+	attributes, err := readAttributes(r)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := createPlainToken(r, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attribute := range attributes {
+		attribute, argument, _ := strings.Cut(attribute, "(")
+		argument = strings.TrimSpace(strings.TrimSuffix(argument, ")"))
+		if argument != "" && attribute != "push" {
+			return nil, fmt.Errorf("@%s takes no argument", attribute)
+		}
+
+		switch attribute {
+		case "identifier":
+			v, ok := token.(FunctionToken)
+			if !ok {
+				return nil, fmt.Errorf("@identifier: token '%s' is not a function token", TokenName(token))
+			}
+			v.Identifier = true
+			token = v
+		case "drop":
+			switch v := token.(type) {
+			case LiteralToken:
+				v.Drop = true
+				token = v
+			case FunctionToken:
+				v.Drop = true
+				token = v
+			default:
+				return nil, fmt.Errorf("@drop: token '%s' has no value to match", TokenName(token))
+			}
+		case "push", "pop":
+			if skip {
+				return nil, fmt.Errorf("@%s: skipped token '%s' cannot change the lexer mode", attribute, TokenName(token))
+			}
+			if attribute == "push" && argument == "" {
+				return nil, fmt.Errorf("@push: expected the mode to push, as in @push(NAME)")
+			}
+			// With both, a match pops and then pushes, switching modes
+			switch v := token.(type) {
+			case LiteralToken:
+				if attribute == "push" {
+					v.Push = argument
+				} else {
+					v.Pop = true
+				}
+				token = v
+			case FunctionToken:
+				if attribute == "push" {
+					v.Push = argument
+				} else {
+					v.Pop = true
+				}
+				token = v
+			default:
+				return nil, fmt.Errorf("@%s: token '%s' has no value to match", attribute, TokenName(token))
+			}
+		default:
+			return nil, fmt.Errorf("unknown token attribute: '@%s'", attribute)
+		}
+	}
+	return token, nil
+}
+
+func createPlainToken(r *bufio.Reader, skip bool) (Token, error) {
 	if err := skipWhitespace(r); err != nil {
 		return nil, err
 	}
@@ -199,6 +591,14 @@ func createToken(r *bufio.Reader) (Token, error) {
 		return nil, err
 	}
 
+	typ, err := readValueType(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "" && skip {
+		return nil, fmt.Errorf("skipped token '%s' cannot have a value type", name)
+	}
+
 	if err := skipWhitespace(r); err != nil {
 		return nil, err
 	}
@@ -209,6 +609,9 @@ func createToken(r *bufio.Reader) (Token, error) {
 	}
 	r.UnreadByte()
 	if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' {
+		if typ != "" {
+			return nil, fmt.Errorf("token '%s' has no text to convert to %s", name, typ)
+		}
 		return SimpleToken{
 			Name: name,
 		}, nil
@@ -222,13 +625,36 @@ func createToken(r *bufio.Reader) (Token, error) {
 		return nil, fmt.Errorf("Expected '=', got '%s'!", eq)
 	}
 
-	// String literal
+	// Built in token
+	if err := skipWhitespace(r); err != nil {
+		return nil, err
+	}
+	if b, err := r.Peek(1); err == nil && b[0] == '@' {
+		token, err := createBuiltinToken(r, name, num, skip)
+		if err != nil {
+			return nil, err
+		}
+		v := token.(FunctionToken)
+		v.Type = typ
+		return v, nil
+	}
+
+	// String literal, i"..." matching case insensitively
+	fold := false
+	if b, err := r.Peek(2); err == nil && b[0] == 'i' && (b[1] == '"' || b[1] == '\'') {
+		r.Discard(1)
+		fold = true
+	}
 	next = stringReader(r)
 	if literal, err := next(); err == nil {
+		if typ != "" {
+			return nil, fmt.Errorf("literal token '%s' has no text to convert to %s", name, typ)
+		}
 		return LiteralToken{
 			Name:       name,
 			Literal:    literal,
 			Precedence: num,
+			Fold:       fold,
 		}, nil
 	}
 
@@ -245,6 +671,7 @@ func createToken(r *bufio.Reader) (Token, error) {
 			Name:       name,
 			Code:       params + code,
 			Precedence: num,
+			Type:       typ,
 		}, nil
 	}
 
@@ -252,6 +679,14 @@ func createToken(r *bufio.Reader) (Token, error) {
 }
 
 func CreateTokens(r *bufio.Reader) ([]Token, error) {
+	return createTokens(r, false)
+}
+
+func CreateSkipTokens(r *bufio.Reader) ([]Token, error) {
+	return createTokens(r, true)
+}
+
+func createTokens(r *bufio.Reader, skip bool) ([]Token, error) {
 	if err := skipWhitespace(r); err != nil {
 		return []Token{}, err
 	}
@@ -266,7 +701,7 @@ func CreateTokens(r *bufio.Reader) ([]Token, error) {
 			return []Token{}, err
 		}
 
-		tok, err := createToken(r)
+		tok, err := createToken(r, skip)
 		if err != nil {
 			return []Token{}, err
 		}
@@ -275,7 +710,7 @@ func CreateTokens(r *bufio.Reader) ([]Token, error) {
 
 	toks := []Token{}
 	for {
-		tok, err := createToken(r)
+		tok, err := createToken(r, skip)
 		if err != nil {
 			return []Token{}, err
 		}
@@ -289,6 +724,15 @@ func CreateTokens(r *bufio.Reader) ([]Token, error) {
 		if err != nil {
 			return []Token{}, err
 		}
+		if b[0] == ';' {
+			r.Discard(1)
+			if err := skipWhitespace(r); err != nil {
+				return []Token{}, err
+			}
+			if b, err = r.Peek(1); err != nil {
+				return []Token{}, err
+			}
+		}
 		if b[0] == ')' {
 			break
 		}
@@ -11,6 +11,9 @@ import (
 
 func main() {
 	outputPath := flag.String("o", "chisel.hpp", "The output file path (default='chisel.hpp').")
+	limits := flag.Bool("limits", false, "Emit recursion depth and step limits into the parser.")
+	ast := flag.Bool("ast", false, "Emit a typed AST class per construct.")
+	visitor := flag.Bool("visitor", false, "Emit visitor and listener base classes and a tree walker.")
 	flag.Parse()
 	filePath := flag.Arg(0)
 
@@ -22,7 +25,12 @@ func main() {
 	}
 	defer file.Close()
 
-	if err := chisel.ReadAndWrite(file, *outputPath); err != nil {
+	opts := chisel.Options{
+		Limits:  *limits,
+		AST:     *ast,
+		Visitor: *visitor,
+	}
+	if err := chisel.ReadAndWriteWithOptions(file, *outputPath, opts); err != nil {
 		log.Fatal("Read failed: ", err)
 	}
 }
@@ -0,0 +1,28 @@
+#ifndef CHISEL_AST_HPP
+#define CHISEL_AST_HPP
+
+#include <memory>
+#include <optional>
+#include <variant>
+#include <vector>
+// #include "Parser.hpp"
+
+namespace chisel {
+
+	// One class per construct, shaped after its rule. Build one from a
+	// successful parse with NAME::build(node).
+	namespace ast {
+
+		using Nodes = std::vector<const Parser::Node *>;
+
+		/*{{.AstDeclarations}}*/
+
+		/*{{.AstClasses}}*/
+
+		/*{{.AstDefinitions}}*/
+
+	}
+
+}
+
+#endif // CHISEL_AST_HPP
@@ -3,7 +3,11 @@
 
 // #include "Lexer.hpp"
 // #include "Token.hpp"
+#include <cstring>
 #include <istream>
+#include <new>
+#include <string>
+#include <type_traits>
 #include <vector>
 
 namespace chisel {
@@ -22,18 +26,20 @@ namespace chisel {
 			};
 			bool leaf;
 			bool delete_handler;
+			const char *label;
 
 		public:
-			Node(const Node &other) : leaf(other.leaf) {
+			Node(const Node &other) : leaf(other.leaf), label(other.label) {
 				const_cast<Node &>(other).delete_handler = false;
 				delete_handler = true;
+				// token is a union member, constructed here rather than assigned
 				if (leaf)
-					token = other.token;
+					new (&token) Token(other.token);
 				else
 					node = other.node;
 			}
-			Node(Token &&token) : token(std::move(token)), leaf(true), delete_handler(true) {}
-			Node(ParseNode *node) : node(node), leaf(false), delete_handler(true) {}
+			Node(Token &&token) : token(std::move(token)), leaf(true), delete_handler(true), label(nullptr) {}
+			Node(ParseNode *node) : node(node), leaf(false), delete_handler(true), label(nullptr) {}
 			~Node() {
 				if (delete_handler) {
 					if (leaf)
@@ -53,6 +59,10 @@ namespace chisel {
 			ParseNode *get_node() { return node; }
 			const ParseNode *get_node() const { return node; }
 
+			// The label given to this node in its construct's rule, as in `name:ID`.
+			const char *get_label() const { return label; }
+			void set_label(const char *label) { this->label = label; }
+
 			static Node failed;
 
 			operator bool() const {
@@ -70,6 +80,7 @@ namespace chisel {
 		private:
 			Type type;
 			std::vector<Node> children;
+			Token::Value value;
 		public:
 			ParseNode(Type type) : type(type), children() {}
 			~ParseNode() = default;
@@ -78,6 +89,36 @@ namespace chisel {
 			std::vector<Node> &get_children() { return children; }
 			const std::vector<Node> &get_children() const { return children; }
 
+			// The value set by the construct's action through `$$`.
+			const Token::Value &get_value() const { return value; }
+			bool has_value() const { return value.index() != 0; }
+			int64_t get_int64() const { return std::get<int64_t>(value); }
+			double get_double() const { return std::get<double>(value); }
+			const std::string &get_string() const { return std::get<std::string>(value); }
+			bool get_bool() const { return std::get<bool>(value); }
+
+			template <typename T>
+			T &result() {
+				if (!std::holds_alternative<T>(value))
+					value = T();
+				return std::get<T>(value);
+			}
+
+			// The first child labelled `label`, or nullptr when there is none.
+			const Node *find(const char *label) const {
+				for (auto &child : children)
+					if (child.get_label() && strcmp(child.get_label(), label) == 0)
+						return &child;
+				return nullptr;
+			}
+			std::vector<const Node *> find_all(const char *label) const {
+				std::vector<const Node *> found;
+				for (auto &child : children)
+					if (child.get_label() && strcmp(child.get_label(), label) == 0)
+						found.push_back(&child);
+				return found;
+			}
+
 			friend std::ostream &operator<<(std::ostream &strm, const ParseNode& node) {
 				for (int i = 0; i < tabs; ++i) strm << "     ";
 				strm << "(PN) Type: " << node.type << '\n';
@@ -91,14 +132,132 @@ namespace chisel {
 			}
 		};
 
+		struct ParseError {
+			enum Kind {
+				SYNTAX,
+				DEPTH_LIMIT,
+				STEP_LIMIT,
+			};
+
+			Kind kind = SYNTAX;
+			std::streamoff position = -1;
+			size_t line = 0;
+			size_t column = 0;
+			std::vector<std::string> expected;
+			std::string found;
+
+			operator bool() const { return position >= 0; }
+
+			std::string message() const {
+				std::string s = "line " + std::to_string(line) + ":" + std::to_string(column) + ": ";
+				if (kind == DEPTH_LIMIT)
+					return s + "maximum nesting depth exceeded";
+				if (kind == STEP_LIMIT)
+					return s + "maximum number of parse steps exceeded";
+				if (expected.empty()) {
+					s += "unexpected ";
+				} else {
+					s += "expected ";
+					for (size_t i = 0; i < expected.size(); ++i) {
+						if (i > 0)
+							s += i + 1 == expected.size() ? " or " : ", ";
+						s += expected[i];
+					}
+					s += ", found ";
+				}
+				s += found.empty() ? "end of input" : "'" + found + "'";
+				return s;
+			}
+		};
+
 	private:
+		static ParseError error;
+		static std::vector<ParseError> errors;
+		static std::streampos origin;
+		static size_t depth;
+		// Set by a sequence failing past its `~`, until a choice gives up
+		static bool cut;
+		// What is skipped before each match: Token::skip unless a construct
+		// declared with @noskip or @skip(...) is being matched
+		static void (*skipper)(std::istream &);
+
+		static void skip(std::istream &reader) { skipper(reader); }
+
+		// Where a parse stands: the position in the input, and how many layout
+		// tokens are taken, as INDENT and DEDENT are taken without moving.
+		struct Mark {
+			std::streampos position;
+			size_t layout;
+
+			operator std::streampos() const { return position; }
+			bool operator==(const Mark &other) const { return position == other.position && layout == other.layout; }
+			bool operator!=(const Mark &other) const { return !(*this == other); }
+		};
+
+		static Mark mark(std::istream &reader);
+		static void restore(std::istream &reader, const Mark &mark);
+		static void truncate(std::vector<Node> &nodes, size_t size);
+		static void splice(std::vector<Node> &nodes, Node &node, ParseNode::Type type);
+		static std::string text(std::istream &reader, std::streampos from, std::streampos to);
+		static void expect(std::istream &reader, std::streampos pos, const char *name);
+		static void enter(std::istream &reader);
+		static void leave(std::istream &reader, bool success);
+		static void locate(std::istream &reader, ParseError &e);
+		static bool recover(std::istream &reader, const Mark &start, Token (*sync)(std::istream &));
+
+		struct Operator {
+			Token (*token)(std::istream &);
+			const char *name;
+			int precedence;
+			bool right;
+		};
+
+		struct OperatorTable {
+			ParseNode::Type type;
+			std::vector<Operator> prefix;
+			std::vector<Operator> infix;
+			bool (*operand)(std::istream &, std::vector<Node> &);
+		};
+
+		static const Operator *match(std::istream &reader, const std::vector<Operator> &ops, int min, Token &token);
+		static bool climb(std::istream &reader, const OperatorTable &table, int min, std::vector<Node> &nodes);
+
+		/*{{if .Limits}}*/
+		static size_t max_depth;
+		static size_t max_steps;
+		static size_t steps;
+		static bool aborted;
+
+		static void abort(std::istream &reader, ParseError::Kind kind);
+		static bool step(std::istream &reader);
+		/*{{end}}*/
+
 		/*{{.RegexPrototypes}}*/
 
 	public:
 		Parser(std::istream &reader) : lexer(reader) {}
 		~Parser() = default;
 
+		static const ParseError &last_error() { return error; }
+		static const std::vector<ParseError> &all_errors() { return errors; }
+
+		/*{{if .Limits}}*/
+		// Zero means unlimited.
+		static void set_max_depth(size_t n) { max_depth = n; }
+		static void set_max_steps(size_t n) { max_steps = n; }
+		/*{{end}}*/
+
+		/*{{if .Externals}}*/
+		// Registers the scanner matching the external token `type`, one
+		// declared as `tok NAME` without a body.
+		static void set_external_scanner(Token::Type type, Token::Scanner scanner) {
+			Token::set_scanner(type, std::move(scanner));
+		}
+		/*{{end}}*/
+
 		/*{{.ConstructPrototypes}}*/
+
+		/*{{.ConstructViews}}*/
 	};
 
 	/*{{.ConstructDefinitions}}*/
@@ -107,11 +266,394 @@ namespace chisel {
 
 	Parser::Node Parser::Node::failed = Parser::Node(nullptr);
 
+	Parser::ParseError Parser::error;
+	std::vector<Parser::ParseError> Parser::errors;
+	std::streampos Parser::origin;
+	size_t Parser::depth = 0;
+	bool Parser::cut = false;
+	void (*Parser::skipper)(std::istream &) = &Token::skip;
+
+	/*{{if .Limits}}*/
+	size_t Parser::max_depth = 0;
+	size_t Parser::max_steps = 0;
+	size_t Parser::steps = 0;
+	bool Parser::aborted = false;
+
+	// Fails the whole parse: every parse function returns false from here on.
+	void Parser::abort(std::istream &reader, ParseError::Kind kind) {
+		if (aborted)
+			return;
+		aborted = true;
+		error = ParseError();
+		error.kind = kind;
+		error.position = std::streamoff(mark(reader).position);
+	}
+
+	bool Parser::step(std::istream &reader) {
+		if (max_steps && ++steps > max_steps)
+			abort(reader, ParseError::STEP_LIMIT);
+		return !aborted;
+	}
+	/*{{end}}*/
+
+	Parser::Mark Parser::mark(std::istream &reader) {
+		reader.clear();
+		Mark mark = { reader.tellg(), 0 };
+		/*{{if .Layout}}*/
+		mark.layout = Token::layout_taken();
+		/*{{end}}*/
+		return mark;
+	}
+
+	void Parser::restore(std::istream &reader, const Mark &mark) {
+		reader.clear();
+		reader.seekg(mark.position, std::ios::beg);
+		/*{{if .Modes}}*/
+		Token::rewind_modes(mark.position);
+		/*{{end}}*/
+		/*{{if .Layout}}*/
+		Token::untake_layout(mark.layout);
+		/*{{end}}*/
+	}
+
+	// Drops the nodes pushed by a failed match. Node cannot be assigned, so
+	// erase and resize are not available.
+	void Parser::truncate(std::vector<Node> &nodes, size_t size) {
+		while (nodes.size() > size)
+			nodes.pop_back();
+	}
+
+	// Adds the children of an inline construct's node in place of the node.
+	// Anything else, such as an error node, is added as is.
+	void Parser::splice(std::vector<Node> &nodes, Node &node, ParseNode::Type type) {
+		if (node.holds_node() && node.get_node()->get_type() == type) {
+			for (auto &child : node.get_node()->get_children())
+				nodes.emplace_back(child);
+			return;
+		}
+		nodes.emplace_back(node);
+	}
+
+	// Reads the input from `from` to `to`, leaving the reader where it stops.
+	std::string Parser::text(std::istream &reader, std::streampos from, std::streampos to) {
+		std::string s(to - from, '\0');
+		reader.clear();
+		reader.seekg(from, std::ios::beg);
+		reader.read(&s[0], s.size());
+		s.resize(reader.gcount());
+		return s;
+	}
+
+	// Records that the token `name` was tried at `pos` and failed. Only the
+	// farthest position reached is kept, along with every token expected there.
+	void Parser::expect(std::istream &reader, std::streampos pos, const char *name) {
+		std::streamoff off = pos;
+		if (off < error.position)
+			return;
+
+		if (off > error.position) {
+			error.position = off;
+			error.expected.clear();
+
+			// Lexing ahead here may take layout tokens, which are given back
+			auto at = mark(reader);
+			at.position = pos;
+			restore(reader, at);
+			Lexer lexer(reader);
+			auto token = lexer.lex();
+			auto end = mark(reader).position;
+			if (!token || end <= pos)
+				end = pos + std::streamoff(1);
+			error.found = text(reader, pos, end);
+			restore(reader, at);
+		}
+
+		for (auto &e : error.expected)
+			if (e == name)
+				return;
+		error.expected.emplace_back(name);
+	}
+
+	void Parser::enter(std::istream &reader) {
+		if (depth++ == 0) {
+			error = ParseError();
+			errors.clear();
+			origin = mark(reader);
+			cut = false;
+			skipper = &Token::skip;
+			/*{{if .Modes}}*/
+			Token::reset_modes();
+			/*{{end}}*/
+			/*{{if .Layout}}*/
+			Token::scan_layout(reader);
+			/*{{end}}*/
+			/*{{if .Limits}}*/
+			steps = 0;
+			aborted = false;
+			/*{{end}}*/
+		}
+		/*{{if .Limits}}*/
+		if (max_depth && depth > max_depth)
+			abort(reader, ParseError::DEPTH_LIMIT);
+		/*{{end}}*/
+	}
+
+	// Finishes the outermost construct: a parse that leaves no input behind
+	// keeps only the errors it recovered from, anything else reports the
+	// farthest failure.
+	void Parser::leave(std::istream &reader, bool success) {
+		if (--depth != 0)
+			return;
+
+		auto end = mark(reader);
+		/*{{if .Limits}}*/
+		if (aborted) {
+			locate(reader, error);
+			errors.push_back(error);
+			restore(reader, end);
+			return;
+		}
+		/*{{end}}*/
+		Token::skip(reader);
+		bool rest = reader.peek() != std::char_traits<char>::eof();
+		auto stop = mark(reader);
+		restore(reader, end);
+
+		if (success && !rest) {
+			error = errors.empty() ? ParseError() : errors.back();
+			return;
+		}
+		if (!error || error.position < std::streamoff(stop.position)) {
+			std::streampos pos = success ? stop.position : origin;
+			error = ParseError();
+			error.position = std::streamoff(pos);
+			error.found = text(reader, pos, pos + std::streamoff(1));
+		}
+
+		locate(reader, error);
+		errors.push_back(error);
+		restore(reader, end);
+	}
+
+	const Parser::Operator *Parser::match(std::istream &reader, const std::vector<Operator> &ops, int min, Token &token) {
+		auto pos = mark(reader);
+		for (auto &op : ops) {
+			if (op.precedence < min)
+				continue;
+			if ((token = op.token(reader)))
+				return &op;
+			expect(reader, pos, op.name);
+		}
+		return nullptr;
+	}
+
+	// Precedence climbing: appends a single node to `nodes`. Operators build
+	// nodes of `table.type` holding (operator, operand) or (left, operator,
+	// right); an operand matching a lone child is used as is.
+	bool Parser::climb(std::istream &reader, const OperatorTable &table, int min, std::vector<Node> &nodes) {
+		/*{{if .Limits}}*/
+		if (!step(reader)) return false;
+		/*{{end}}*/
+		skip(reader);
+		auto start = mark(reader);
+		Token token = Token::failed;
+		std::vector<Node> left;
+		std::vector<Node> operand;
+
+		if (auto op = match(reader, table.prefix, 0, token)) {
+			if (!climb(reader, table, op->precedence, operand)) {
+				restore(reader, start);
+				return false;
+			}
+			auto node = new ParseNode(table.type);
+			node->get_children().emplace_back(std::move(token));
+			node->get_children().emplace_back(operand[0]);
+			left.emplace_back(node);
+		} else if (table.operand(reader, operand)) {
+			if (operand.size() == 1) {
+				left.emplace_back(operand[0]);
+			} else {
+				auto node = new ParseNode(table.type);
+				for (auto &child : operand)
+					node->get_children().emplace_back(child);
+				left.emplace_back(node);
+			}
+		} else {
+			restore(reader, start);
+			return false;
+		}
+
+		for (;;) {
+			skip(reader);
+			auto pos = mark(reader);
+			auto op = match(reader, table.infix, min, token);
+			if (!op)
+				break;
+
+			std::vector<Node> right;
+			if (!climb(reader, table, op->right ? op->precedence : op->precedence + 1, right)) {
+				restore(reader, pos);
+				if (cut)
+					return false;
+				break;
+			}
+			auto node = new ParseNode(table.type);
+			node->get_children().emplace_back(left[0]);
+			node->get_children().emplace_back(std::move(token));
+			node->get_children().emplace_back(right[0]);
+			left.clear();
+			left.emplace_back(node);
+		}
+
+		nodes.emplace_back(left[0]);
+		return true;
+	}
+
+	void Parser::locate(std::istream &reader, ParseError &e) {
+		e.line = 1;
+		e.column = 1;
+		reader.clear();
+		reader.seekg(origin, std::ios::beg);
+		for (auto i = std::streamoff(origin); i < e.position; ++i) {
+			auto c = reader.get();
+			if (c == std::char_traits<char>::eof())
+				break;
+			if (c == '\n') {
+				++e.line;
+				e.column = 1;
+			} else {
+				++e.column;
+			}
+		}
+	}
+
+	// Panic mode recovery: skips from the failure up to and including the
+	// next `sync` token, records the failure and starts tracking afresh.
+	// Gives up (restoring `start`) if the input runs out first.
+	bool Parser::recover(std::istream &reader, const Mark &start, Token (*sync)(std::istream &)) {
+		/*{{if .Limits}}*/
+		if (aborted)
+			return false;
+		/*{{end}}*/
+		ParseError e = error;
+		if (!e || e.position < std::streamoff(start.position)) {
+			e = ParseError();
+			e.position = std::streamoff(start.position);
+			e.found = text(reader, start, start.position + std::streamoff(1));
+		}
+
+		auto failure = start;
+		failure.position = e.position;
+		restore(reader, failure);
+		for (;;) {
+			skip(reader);
+			if (reader.peek() == std::char_traits<char>::eof()) {
+				restore(reader, start);
+				return false;
+			}
+			if (sync(reader))
+				break;
+
+			auto pos = mark(reader);
+			Lexer lexer(reader);
+			if (!lexer.lex() || mark(reader).position <= pos.position) {
+				restore(reader, pos);
+				reader.get();
+			}
+		}
+
+		auto end = mark(reader);
+		locate(reader, e);
+		errors.push_back(e);
+		error = ParseError();
+		cut = false;
+		restore(reader, end);
+		return true;
+	}
+
 	std::ostream &operator<<(std::ostream &strm, const Parser::Node &node) {
 		if (node.holds_token())
 			return strm << node.get_token();
 		return strm << *node.get_node();
 	}
+
+	/*{{if .Visitor}}*/
+	// Dispatches each node to the visit_NAME of its construct or token. By
+	// default constructs visit their children, returning the last result,
+	// and tokens return R().
+	template <typename R = void>
+	class Visitor {
+	public:
+		virtual ~Visitor() = default;
+
+		R visit(const Parser::Node &node) {
+			if (!node)
+				return R();
+			if (node.holds_token()) {
+				switch (node.get_token().get_type()) {
+				/*{{.VisitorTokenCases}}*/
+				default:
+					return R();
+				}
+			}
+			switch (node.get_node()->get_type()) {
+			/*{{.VisitorConstructCases}}*/
+			default:
+				return R();
+			}
+		}
+
+		R visit_children(const Parser::ParseNode &node) {
+			if constexpr (std::is_void_v<R>) {
+				for (auto &child : node.get_children())
+					visit(child);
+			} else {
+				R result{};
+				for (auto &child : node.get_children())
+					result = visit(child);
+				return result;
+			}
+		}
+
+		/*{{.VisitorMethods}}*/
+	};
+
+	// Receives enter_NAME and exit_NAME around the children of each construct
+	// node and visit_NAME for each token as Walker::walk goes over a tree.
+	class Listener {
+	public:
+		virtual ~Listener() = default;
+
+		/*{{.ListenerMethods}}*/
+	};
+
+	class Walker {
+	public:
+		// Walks the tree under node depth first, in input order.
+		static void walk(Listener &listener, const Parser::Node &node) {
+			if (!node)
+				return;
+			if (node.holds_token()) {
+				switch (node.get_token().get_type()) {
+				/*{{.WalkerTokenCases}}*/
+				default:
+					break;
+				}
+				return;
+			}
+
+			auto &n = *node.get_node();
+			switch (n.get_type()) {
+			/*{{.WalkerEnterCases}}*/
+			}
+			for (auto &child : n.get_children())
+				walk(listener, child);
+			switch (n.get_type()) {
+			/*{{.WalkerExitCases}}*/
+			}
+		}
+	};
+	/*{{end}}*/
 }
 
 #endif // CHISEL_PARSER_HPP
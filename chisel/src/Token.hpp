@@ -1,9 +1,17 @@
 #ifndef CHISEL_TOKEN_HPP
 #define CHISEL_TOKEN_HPP
 
+#include <cctype>
+#include <cerrno>
+#include <cstdint>
+#include <cstdlib>
 #include <cstring>
+#include <functional>
 #include <ostream>
 #include <iostream>
+#include <string>
+#include <variant>
+#include <vector>
 
 namespace chisel {
 
@@ -15,15 +23,19 @@ namespace chisel {
 			/*{{.TokenTypes}}*/
 		};
 
+		// The converted value of tokens declared with a type, e.g. `tok INT: int64`.
+		using Value = std::variant<std::monostate, int64_t, double, std::string, bool>;
+
 	private:
-		Type type;
-		char *data;
+		Type type{};
+		char *data = nullptr;
+		Value value;
 
 		static char failed_data;
 	public:
 		Token() = default;
 		Token(Type type, char *data) : type(type), data(data) {}
-		Token(const Token &other) : type(other.type) {
+		Token(const Token &other) : type(other.type), value(other.value) {
 			if (!other) {
 				data = other.data;
 			} else if (other.data) {
@@ -35,7 +47,7 @@ namespace chisel {
 				data = nullptr;
 			}
 		}
-		Token(Token &&other) : type(other.type), data(other.data) {
+		Token(Token &&other) : type(other.type), data(other.data), value(std::move(other.value)) {
 			other.data = nullptr;
 		}
 		~Token() {
@@ -45,6 +57,7 @@ namespace chisel {
 
 		Token &operator=(const Token &other) {
 			type = other.type;
+			value = other.value;
 			if (!other) {
 				data = other.data;
 			} else if (other.data) {
@@ -60,6 +73,7 @@ namespace chisel {
 		Token &operator=(Token &&other) {
 			type = other.type;
 			data = other.data;
+			value = std::move(other.value);
 			other.data = nullptr;
 			return *this;
 		}
@@ -79,6 +93,13 @@ namespace chisel {
 		char *get_data() { return data; }
 		const char *get_data() const { return data; }
 
+		const Value &get_value() const { return value; }
+		bool has_value() const { return value.index() != 0; }
+		int64_t get_int64() const { return std::get<int64_t>(value); }
+		double get_double() const { return std::get<double>(value); }
+		const std::string &get_string() const { return std::get<std::string>(value); }
+		bool get_bool() const { return std::get<bool>(value); }
+
 		void set_type(Type type) {
 			this->type = type;
 		}
@@ -92,14 +113,352 @@ namespace chisel {
 			return data != failed.data;
 		}
 
+		void set_value(Value value) {
+			this->value = std::move(value);
+		}
+
+		// Conversions run once by the lexer for typed tokens. Each fails when
+		// the whole of the token's text is not a valid value.
+		static bool convert_int64(Token &token) {
+			if (!token.data || !*token.data)
+				return false;
+			char *end;
+			errno = 0;
+			long long n = std::strtoll(token.data, &end, 10);
+			if (*end || errno == ERANGE)
+				return false;
+			token.value = static_cast<int64_t>(n);
+			return true;
+		}
+		static bool convert_double(Token &token) {
+			if (!token.data || !*token.data)
+				return false;
+			char *end;
+			errno = 0;
+			double n = std::strtod(token.data, &end);
+			if (*end || errno == ERANGE)
+				return false;
+			token.value = n;
+			return true;
+		}
+		static bool convert_string(Token &token) {
+			token.value = std::string(token.data ? token.data : "");
+			return true;
+		}
+		static bool convert_bool(Token &token) {
+			if (!token.data)
+				return false;
+			if (strcmp(token.data, "true") == 0)
+				token.value = true;
+			else if (strcmp(token.data, "false") == 0)
+				token.value = false;
+			else
+				return false;
+			return true;
+		}
+
+		static Token make(Type type, const std::string &text) {
+			char *data = new char[text.size() + 1];
+			memcpy(data, text.data(), text.size());
+			data[text.size()] = 0;
+			return Token(type, data);
+		}
+
+		// Decodes one UTF-8 code point, failing on malformed input.
+		static bool read_utf8(std::istream &reader, char32_t &c) {
+			int b = reader.get();
+			if (b == std::char_traits<char>::eof())
+				return false;
+
+			int n = 0;
+			if (b < 0x80) {
+				c = b;
+			} else if ((b & 0xe0) == 0xc0) {
+				c = b & 0x1f;
+				n = 1;
+			} else if ((b & 0xf0) == 0xe0) {
+				c = b & 0x0f;
+				n = 2;
+			} else if ((b & 0xf8) == 0xf0) {
+				c = b & 0x07;
+				n = 3;
+			} else {
+				return false;
+			}
+
+			while (n--) {
+				b = reader.get();
+				if (b == std::char_traits<char>::eof() || (b & 0xc0) != 0x80)
+					return false;
+				c = (c << 6) | (b & 0x3f);
+			}
+			return true;
+		}
+
+		// Whether the next character cannot continue an identifier. Any
+		// non-ASCII byte is taken to be part of one.
+		static bool at_word_end(std::istream &reader) {
+			auto next = reader.peek();
+			if (next == std::char_traits<char>::eof()) {
+				reader.clear();
+				return true;
+			}
+			return next < 0x80 && !std::isalnum(next) && next != '_';
+		}
+
+		/*{{if .Modes}}*/
+		// Lexer modes: a token declared in a mode only matches while it is
+		// the current one, the top of a stack changed by the tokens declared
+		// with @push(NAME) and @pop.
+		enum class Mode {
+			DEFAULT,
+			/*{{.ModeNames}}*/
+		};
+
+	private:
+		struct ModeChange {
+			std::streamoff position;
+			bool push;
+			Mode mode;
+		};
+		static std::vector<Mode> modes;
+		static std::vector<ModeChange> mode_changes;
+
+	public:
+		static Mode mode() {
+			return modes.empty() ? Mode::DEFAULT : modes.back();
+		}
+
+		static void push_mode(std::istream &reader, Mode mode) {
+			reader.clear();
+			mode_changes.push_back({ std::streamoff(reader.tellg()), true, mode });
+			modes.push_back(mode);
+		}
+
+		// Popping DEFAULT leaves it the current mode.
+		static void pop_mode(std::istream &reader) {
+			if (modes.empty())
+				return;
+			reader.clear();
+			mode_changes.push_back({ std::streamoff(reader.tellg()), false, modes.back() });
+			modes.pop_back();
+		}
+
+		// Undoes the changes made by tokens ending past `pos`, for a parser
+		// backtracking to it.
+		static void rewind_modes(std::streampos pos) {
+			while (!mode_changes.empty() && mode_changes.back().position > std::streamoff(pos)) {
+				if (mode_changes.back().push)
+					modes.pop_back();
+				else
+					modes.push_back(mode_changes.back().mode);
+				mode_changes.pop_back();
+			}
+		}
+
+		static void reset_modes() {
+			modes.clear();
+			mode_changes.clear();
+		}
+		/*{{end}}*/
+
+		/*{{if .Externals}}*/
+		// External tokens, declared without a body, are matched by the
+		// scanner registered for them through Parser::set_external_scanner.
+		// A scanner returns Token::failed when it does not match, and an
+		// external token without one never does.
+		using Scanner = std::function<Token(std::istream &)>;
+
+	private:
+		static std::vector<Scanner> scanners;
+
+	public:
+		static void set_scanner(Type type, Scanner scanner) {
+			if (size_t(type) >= scanners.size())
+				scanners.resize(size_t(type) + 1);
+			scanners[type] = std::move(scanner);
+		}
+
+		static Token scan_external(std::istream &reader, Type type) {
+			if (size_t(type) >= scanners.size() || !scanners[type])
+				return Token::failed;
+			reader.clear();
+			auto start = reader.tellg();
+			Token token = scanners[type](reader);
+			if (!token) {
+				reader.clear();
+				reader.seekg(start, std::ios::beg);
+			}
+			return token;
+		}
+		/*{{end}}*/
+
+		/*{{if .Layout}}*/
+		// Layout: NEWLINE ends a line holding tokens, INDENT starts a line
+		// indented deeper than the one before, and DEDENT closes an indented
+		// block, one for each level a line drops back. Blank lines, and
+		// lines holding nothing but skipped text, do not count. The layout
+		// of the whole input is worked out by scan_layout when a parse
+		// starts, and taken a token at a time as the parse reaches it.
+		enum class Layout { NEWLINE, INDENT, DEDENT };
+
+	private:
+		struct LayoutToken {
+			std::streamoff position;
+			std::streamoff end;
+			Layout kind;
+		};
+		static std::vector<LayoutToken> layout;
+		// The first layout token not taken yet
+		static size_t layout_next;
+		// Only the layout tokens the grammar declares are worked out
+		static constexpr bool layout_newlines = /*{{.LayoutNewlines}}*/;
+		static constexpr bool layout_indents = /*{{.LayoutIndents}}*/;
+
+		// Runs the skip tokens until none of them matches.
+		static void skip_all(std::istream &reader) {
+			reader.clear();
+			for (auto before = reader.tellg();;) {
+				skip_tokens(reader);
+				reader.clear();
+				auto after = reader.tellg();
+				if (after == before)
+					return;
+				before = after;
+			}
+		}
+
+	public:
+		static void scan_layout(std::istream &reader) {
+			layout.clear();
+			layout_next = 0;
+			reader.clear();
+			auto origin = reader.tellg();
+			reader.seekg(0, std::ios::end);
+			std::streamoff eof = reader.tellg();
+			reader.seekg(origin, std::ios::beg);
+
+			std::vector<size_t> levels = { 0 };
+			// The line break ending the last line holding tokens
+			std::streamoff newline = -1;
+			for (;;) {
+				size_t width = 0;
+				for (int c = reader.peek(); c == ' ' || c == '\t'; c = reader.peek()) {
+					reader.get();
+					width = c == '\t' ? (width / 8 + 1) * 8 : width + 1;
+				}
+				reader.clear();
+				std::streamoff text = reader.tellg();
+
+				skip_all(reader);
+				std::streamoff after = reader.tellg();
+				bool blank = reader.peek() == '\n' || reader.peek() == std::char_traits<char>::eof();
+				reader.clear();
+				reader.seekg(text, std::ios::beg);
+				for (auto i = text; i < after && !blank; ++i)
+					blank = reader.get() == '\n';
+				reader.clear();
+
+				if (!blank) {
+					if (newline >= 0 && layout_newlines)
+						layout.push_back({ newline, newline < eof ? newline + 1 : eof, Layout::NEWLINE });
+					for (; width < levels.back() && layout_indents; levels.pop_back())
+						layout.push_back({ text, text, Layout::DEDENT });
+					if (width > levels.back() && layout_indents) {
+						levels.push_back(width);
+						layout.push_back({ text, text, Layout::INDENT });
+					}
+				}
+
+				reader.seekg(text, std::ios::beg);
+				int c;
+				while ((c = reader.get()) != std::char_traits<char>::eof() && c != '\n')
+					;
+				reader.clear();
+				if (!blank)
+					newline = c == '\n' ? std::streamoff(reader.tellg()) - 1 : eof;
+				if (c == std::char_traits<char>::eof())
+					break;
+			}
+			if (newline >= 0 && layout_newlines)
+				layout.push_back({ newline, newline < eof ? newline + 1 : eof, Layout::NEWLINE });
+			for (; levels.size() > 1; levels.pop_back())
+				layout.push_back({ eof, eof, Layout::DEDENT });
+			reader.seekg(origin, std::ios::beg);
+		}
+
+		// Takes the next layout token if it is a `kind` standing at the
+		// current position. Those the parse went past count as taken.
+		static bool take_layout(std::istream &reader, Layout kind) {
+			reader.clear();
+			std::streamoff pos = reader.tellg();
+			while (layout_next < layout.size() && layout[layout_next].position < pos)
+				++layout_next;
+			if (layout_next == layout.size() || layout[layout_next].position != pos || layout[layout_next].kind != kind)
+				return false;
+			reader.seekg(layout[layout_next++].end, std::ios::beg);
+			return true;
+		}
+
+		// Whether a layout token not taken yet stands at the current
+		// position, where no other token matches.
+		static bool layout_pending(std::istream &reader) {
+			reader.clear();
+			std::streamoff pos = reader.tellg();
+			for (auto i = layout_next; i < layout.size() && layout[i].position <= pos; ++i)
+				if (layout[i].position == pos)
+					return true;
+			return false;
+		}
+
+		// How many layout tokens are taken, which Parser::mark records and
+		// Parser::restore gives back to. INDENT and DEDENT take no text, so
+		// the position alone cannot tell whether they were taken.
+		static size_t layout_taken() {
+			return layout_next;
+		}
+
+		static void untake_layout(size_t taken) {
+			layout_next = taken;
+		}
+		/*{{end}}*/
+
 		/*{{.TokenPrototypes}}*/
 	};
 
 	char Token::failed_data = 'a';
 	Token Token::failed = Token(static_cast<Token::Type>(0), &Token::failed_data);
+	/*{{if .Modes}}*/
+	std::vector<Token::Mode> Token::modes;
+	std::vector<Token::ModeChange> Token::mode_changes;
+	/*{{end}}*/
+	/*{{if .Externals}}*/
+	std::vector<Token::Scanner> Token::scanners;
+	/*{{end}}*/
+	/*{{if .Layout}}*/
+	std::vector<Token::LayoutToken> Token::layout;
+	size_t Token::layout_next = 0;
+	/*{{end}}*/
 
 	/*{{.TokenDefinitions}}*/
 
+	/*{{if .Layout}}*/
+	// Skips as the skip tokens do, but stops at a line break that is a
+	// NEWLINE still to be taken.
+	void Token::skip(std::istream &reader) {
+		reader.clear();
+		std::streamoff start = reader.tellg();
+		skip_all(reader);
+		std::streamoff end = reader.tellg();
+		for (auto i = layout_next; i < layout.size() && layout[i].position < end; ++i) {
+			if (layout[i].kind == Layout::NEWLINE && layout[i].position >= start) {
+				reader.seekg(layout[i].position, std::ios::beg);
+				return;
+			}
+		}
+	}
+	/*{{end}}*/
+
 }
 
 #endif // CHISEL_TOKEN_HPP